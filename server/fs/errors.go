@@ -13,3 +13,16 @@ func (e NotFoundError) Error() string {
 func NewNotFoundError(path string) NotFoundError {
 	return NotFoundError{path: path}
 }
+
+// PermissionError is returned when user is not allowed to access path
+type PermissionError struct {
+	path string
+}
+
+func (e PermissionError) Error() string {
+	return fmt.Sprintf("permission denied for %s", e.path)
+}
+
+func NewPermissionError(path string) PermissionError {
+	return PermissionError{path: path}
+}
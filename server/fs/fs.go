@@ -2,14 +2,40 @@ package fs
 
 import (
 	"io"
+	"os"
+	"time"
 )
 
 type Filesystem interface {
 	List(directory string) (FileList, error)
 	Retrieve(path string) (io.Reader, error)
+	// Store must not make partially written data visible under path, when it fails the previous content stays
 	Store(path string, data io.Reader) error
 	Exists(path string) (bool, error)
 	Rename(oldpath, newpath string) error
 	Delete(deletePath string) error
 	CreateDirectory(path string) error
 }
+
+// SpaceReporter is optional capability of Filesystem, ALLO uses it to refuse uploads that would not fit
+type SpaceReporter interface {
+	// AvailableSpace returns number of bytes that can be stored in directory
+	AvailableSpace(directory string) (int64, error)
+}
+
+// ModTimeSetter is optional capability of Filesystem, MFMT, MDTM and SITE UTIME use it to keep modification time of uploaded files
+type ModTimeSetter interface {
+	SetModTime(path string, modTime time.Time) error
+}
+
+// PermissionChanger is optional capability of Filesystem, used by SITE CHMOD
+type PermissionChanger interface {
+	// Chmod sets permission bits of path, other mode bits are not changed
+	Chmod(path string, permissions os.FileMode) error
+}
+
+// Symlinker is optional capability of Filesystem, used by SITE SYMLINK
+type Symlinker interface {
+	// Symlink creates link pointing to target, both are paths of the filesystem
+	Symlink(target string, link string) error
+}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"path/filepath"
 	"server/fs"
+	"strings"
+	"time"
 )
 
 // MappedFS implements Filesystem
@@ -27,7 +29,7 @@ func (mfs *MappedFS) List(directory string) (fs.FileList, error) {
 
 	entries, err := os.ReadDir(realPath)
 	if err != nil {
-		return nil, fmt.Errorf("error reading reading directory in folder %s(%s): %s", directory, realPath, err)
+		return nil, mapError(directory, fmt.Sprintf("error reading reading directory in folder %s(%s)", directory, realPath), err)
 	}
 
 	mappedEntries := make([]fs.File, len(entries))
@@ -62,31 +64,63 @@ func (mfs *MappedFS) Retrieve(path string) (io.Reader, error) {
 	realPath := mfs.resolveMappedToReal(path)
 
 	file, err := os.Open(realPath)
-	if errors.Is(err, os.ErrNotExist) {
-		return nil, fs.NewNotFoundError(path)
-	}
 	if err != nil {
-		return nil, fmt.Errorf("retrieve file %s:%s", path, err)
+		return nil, mapError(path, fmt.Sprintf("retrieve file %s", path), err)
 	}
 
 	log.Printf("File reader received for file %s(%s)", path, realPath)
 	return file, nil
 }
 
+// Store writes data to temporary file next to the destination and renames it into place once all data is written,
+// so partial upload never appears under the final name. On error the temporary file is removed.
 func (mfs *MappedFS) Store(path string, data io.Reader) error {
 	realPath := mfs.resolveMappedToReal(path)
-	file, err := os.OpenFile(realPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
 
+	file, err := os.CreateTemp(filepath.Dir(realPath), "."+filepath.Base(realPath)+".*.part")
+	if err != nil {
+		return mapError(path, "creating temporary file", err)
+	}
+	tempPath := file.Name()
+
+	err = mfs.writeTempFile(file, realPath, data)
+	if err != nil {
+		removeErr := os.Remove(tempPath)
+		if removeErr != nil {
+			log.Printf("Error removing temporary file %s: %s", tempPath, removeErr)
+		}
+		return err
+	}
+
+	err = os.Rename(tempPath, realPath)
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return mapError(path, "renaming temporary file into place", err)
+	}
+
+	log.Printf("data copied")
+
+	return nil
+
+}
+
+// writeTempFile copies data to file and closes it, overwritten file keeps its permissions
+func (mfs *MappedFS) writeTempFile(file *os.File, realPath string, data io.Reader) error {
 	defer func() {
 		err := file.Close()
-		if err != nil {
+		if err != nil && !errors.Is(err, os.ErrClosed) {
 			log.Printf("Eror closing file: %s", err)
-
 		}
 	}()
 
+	permissions := os.FileMode(0644)
+	if info, err := os.Stat(realPath); err == nil {
+		permissions = info.Mode().Perm()
+	}
+
+	err := file.Chmod(permissions)
 	if err != nil {
-		return fmt.Errorf("opening file for writing: %s", err)
+		return fmt.Errorf("setting permissions of temporary file: %s", err)
 	}
 
 	log.Printf("file opened, starting to copy data")
@@ -95,10 +129,12 @@ func (mfs *MappedFS) Store(path string, data io.Reader) error {
 		return fmt.Errorf("copying from data to file: %s", err)
 	}
 
-	log.Printf("data copied")
-
-	return nil
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("syncing file: %s", err)
+	}
 
+	return file.Close()
 }
 
 func (mfs *MappedFS) Exists(path string) (bool, error) {
@@ -111,7 +147,7 @@ func (mfs *MappedFS) Exists(path string) (bool, error) {
 		return false, nil
 	}
 
-	return false, fmt.Errorf("mapped fs error: %s", err)
+	return false, mapError(path, "mapped fs error", err)
 
 }
 
@@ -121,7 +157,7 @@ func (mfs *MappedFS) Rename(from string, to string) error {
 
 	err := os.Rename(realFrom, realTo)
 	if err != nil {
-		return fmt.Errorf("mapped fs error: %s", err)
+		return mapError(from, "mapped fs error", err)
 	}
 
 	log.Printf("MappedOS: file %s renamed to %s", from, to)
@@ -133,7 +169,7 @@ func (mfs *MappedFS) Delete(deletePath string) error {
 
 	err := os.Remove(realPath)
 	if err != nil {
-		return fmt.Errorf("mapped fs error: %s", err)
+		return mapError(deletePath, "mapped fs error", err)
 	}
 
 	log.Printf("MappedFS: file %s deleted", deletePath)
@@ -146,7 +182,7 @@ func (mfs *MappedFS) CreateDirectory(directory string) error {
 
 	err := os.Mkdir(realPath, 0777)
 	if err != nil {
-		return fmt.Errorf("mapped fs error: %s", err)
+		return mapError(directory, "mapped fs error", err)
 	}
 
 	log.Printf("MappedFS: directory %s created", directory)
@@ -154,11 +190,116 @@ func (mfs *MappedFS) CreateDirectory(directory string) error {
 	return nil
 }
 
+// SetModTime changes modification time of file, access time is set to now
+func (mfs *MappedFS) SetModTime(path string, modTime time.Time) error {
+	realPath := mfs.resolveMappedToReal(path)
+
+	err := os.Chtimes(realPath, time.Now(), modTime)
+	if err != nil {
+		return mapError(path, "mapped fs error", err)
+	}
+
+	log.Printf("MappedFS: modification time of %s set to %s", path, modTime)
+	return nil
+}
+
+func (mfs *MappedFS) Chmod(path string, permissions os.FileMode) error {
+	realPath := mfs.resolveMappedToReal(path)
+
+	err := os.Chmod(realPath, permissions.Perm())
+	if err != nil {
+		return mapError(path, "mapped fs error", err)
+	}
+
+	log.Printf("MappedFS: permissions of %s set to %s", path, permissions.Perm())
+	return nil
+}
+
+// Symlink creates link to target relative to the link, so it keeps working when the root is moved.
+// Both paths are resolved through links already on disk and link is refused when either ends up outside of the root.
+func (mfs *MappedFS) Symlink(target string, link string) error {
+	realRoot, err := filepath.EvalSymlinks(mfs.osFSRoot)
+	if err != nil {
+		return fmt.Errorf("mapped fs error: %s", err)
+	}
+
+	realTarget, err := resolveInRoot(realRoot, target)
+	if err != nil {
+		return err
+	}
+	realLink, err := resolveInRoot(realRoot, link)
+	if err != nil {
+		return err
+	}
+
+	// kernel resolves relative target from the real directory of the link
+	relativeTarget, err := filepath.Rel(filepath.Dir(realLink), realTarget)
+	if err != nil {
+		return fmt.Errorf("mapped fs error: %s", err)
+	}
+
+	err = os.Symlink(relativeTarget, realLink)
+	if err != nil {
+		return mapError(link, "mapped fs error", err)
+	}
+
+	log.Printf("MappedFS: symlink %s to %s created", link, target)
+	return nil
+}
+
+// resolveInRoot returns real path of mapped path with links in its directory resolved,
+// path that resolves outside of realRoot is refused with permission error
+func resolveInRoot(realRoot string, path string) (string, error) {
+	clearedPath := filepath.Clean("/" + path)
+	if clearedPath == "/" {
+		return realRoot, nil
+	}
+
+	realDirectory, err := filepath.EvalSymlinks(filepath.Join(realRoot, filepath.Dir(clearedPath)))
+	if err != nil {
+		return "", mapError(path, "mapped fs error", err)
+	}
+	if !isInside(realRoot, realDirectory) {
+		return "", fs.NewPermissionError(path)
+	}
+	realPath := filepath.Join(realDirectory, filepath.Base(clearedPath))
+
+	// existing link at the path itself must not lead outside either
+	resolvedPath, err := filepath.EvalSymlinks(realPath)
+	if err == nil && !isInside(realRoot, resolvedPath) {
+		return "", fs.NewPermissionError(path)
+	}
+
+	return realPath, nil
+}
+
+// isInside reports whether realPath is realRoot or lies under it
+func isInside(realRoot string, realPath string) bool {
+	relativePath, err := filepath.Rel(realRoot, realPath)
+	if err != nil {
+		return false
+	}
+
+	return relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator))
+}
+
 func (mfs *MappedFS) resolveMappedToReal(relativePath string) string {
-	// ensures that file that is not inside osFSRoot is permitted
-	clearedPath := filepath.Clean(relativePath)
+	// ensures that file that is not inside osFSRoot is not permitted, cleaning absolute path removes leading ..
+	clearedPath := filepath.Clean("/" + relativePath)
 	realPath := filepath.Join(mfs.osFSRoot, clearedPath)
 	log.Printf("rel filepath %s resolved to %s", relativePath, realPath)
 
 	return realPath
 }
+
+// mapError converts error of os package to filesystem error, so server can report it with matching reply
+func mapError(path string, msg string, err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fs.NewNotFoundError(path)
+	case errors.Is(err, os.ErrPermission):
+		return fs.NewPermissionError(path)
+	default:
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+}
@@ -0,0 +1,126 @@
+package mapedfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"server/fs"
+	"testing"
+)
+
+// newTestFS returns filesystem on temporary root holding a.txt and directory outside of the root
+func newTestFS(t *testing.T) (*MappedFS, string, string) {
+	t.Helper()
+
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, directory := range []string{root, outside} {
+		err = os.Mkdir(directory, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesystem, err := CreateFS(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filesystem, root, outside
+}
+
+func TestSymlinkIsRelative(t *testing.T) {
+	filesystem, root, _ := newTestFS(t)
+	err := filesystem.CreateDirectory("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = filesystem.Symlink("/a.txt", "/dir/link")
+	if err != nil {
+		t.Fatalf("Symlink: %s", err)
+	}
+
+	target, err := os.Readlink(filepath.Join(root, "dir", "link"))
+	if err != nil || target != filepath.Join("..", "a.txt") {
+		t.Errorf("link target = %q, %v, want ../a.txt", target, err)
+	}
+}
+
+func TestSymlinkThroughLinkStaysInRoot(t *testing.T) {
+	filesystem, root, _ := newTestFS(t)
+
+	// x points to the root, link created through x must not point to parent of the root
+	err := filesystem.Symlink("/", "/x")
+	if err != nil {
+		t.Fatalf("Symlink / x: %s", err)
+	}
+	err = filesystem.Symlink("/", "/x/y")
+	if err != nil {
+		t.Fatalf("Symlink / x/y: %s", err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, "y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != root {
+		t.Errorf("y resolves to %s, want %s", resolved, root)
+	}
+
+	files, err := filesystem.List("/y")
+	if err != nil {
+		t.Fatalf("List /y: %s", err)
+	}
+	found := false
+	for _, file := range files {
+		found = found || file.Name == "a.txt"
+	}
+	if !found {
+		t.Errorf("List /y = %v, want content of the root", files)
+	}
+}
+
+func TestSymlinkOutsideOfRootIsRefused(t *testing.T) {
+	filesystem, root, outside := newTestFS(t)
+
+	// link leading outside, e.g. created on the server by administrator
+	err := os.Symlink(outside, filepath.Join(root, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		link   string
+	}{
+		{name: "link in directory outside", target: "/a.txt", link: "/out/link"},
+		{name: "target in directory outside", target: "/out/file", link: "/link"},
+		{name: "target is link outside", target: "/out", link: "/link"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := filesystem.Symlink(test.target, test.link)
+
+			var permissionError fs.PermissionError
+			if !errors.As(err, &permissionError) {
+				t.Errorf("error = %v, want permission error", err)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("directory outside of the root changed: %v, %v", entries, err)
+	}
+}
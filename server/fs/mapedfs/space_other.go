@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package mapedfs
+
+import "errors"
+
+// AvailableSpace is not supported on this platform
+func (mfs *MappedFS) AvailableSpace(directory string) (int64, error) {
+	return 0, errors.New("mapped fs error: available space is not supported")
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+
+package mapedfs
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// AvailableSpace returns space available to unprivileged users on filesystem containing directory
+func (mfs *MappedFS) AvailableSpace(directory string) (int64, error) {
+	realPath := mfs.resolveMappedToReal(directory)
+
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(realPath, &stat)
+	if err != nil {
+		return 0, fmt.Errorf("mapped fs error: %s", err)
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
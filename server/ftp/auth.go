@@ -1,5 +1,86 @@
 package ftp
 
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+type CertificateMatch int
+
+const (
+	MATCH_COMMON_NAME CertificateMatch = iota // subject CN
+	MATCH_SAN                                 // DNS name, email or URI from subject alternative names
+	MATCH_FINGERPRINT                         // hex encoded SHA-256 of the certificate, colons are ignored
+)
+
+// CertificateMapping assigns TLS client certificate to user.
+// CN and SAN are only trusted when the certificate chain was verified (TLSConfig.ClientCAs),
+// fingerprint identifies exact certificate, so it also works for self-signed ones.
+type CertificateMapping struct {
+	Username string
+	Match    CertificateMatch
+	Value    string
+	// RequirePassword means that user has to present both certificate and password,
+	// otherwise certificate alone logs the user in and PASS is skipped
+	RequirePassword bool
+}
+
 func authenticateUser(username string, password string) bool {
 	return username == "zm" && password == "password"
 }
+
+// matches checks if mapping applies to certificate presented on connection
+func (mapping CertificateMapping) matches(state tls.ConnectionState) bool {
+	if len(state.PeerCertificates) == 0 {
+		return false
+	}
+	certificate := state.PeerCertificates[0]
+
+	switch mapping.Match {
+	case MATCH_FINGERPRINT:
+		fingerprint := sha256.Sum256(certificate.Raw)
+		expected := strings.ReplaceAll(mapping.Value, ":", "")
+		return strings.EqualFold(hex.EncodeToString(fingerprint[:]), expected)
+	case MATCH_COMMON_NAME:
+		return len(state.VerifiedChains) > 0 && certificate.Subject.CommonName == mapping.Value
+	case MATCH_SAN:
+		if len(state.VerifiedChains) == 0 {
+			return false
+		}
+
+		if slices.Contains(certificate.DNSNames, mapping.Value) || slices.Contains(certificate.EmailAddresses, mapping.Value) {
+			return true
+		}
+
+		return slices.ContainsFunc(certificate.URIs, func(uri *url.URL) bool { return uri.String() == mapping.Value })
+	}
+
+	return false
+}
+
+// certificateMapping finds mapping of client certificate on control connection for the user
+func (session *SessionInfo) certificateMapping(username string) (CertificateMapping, bool) {
+	state, ok := session.controlConnection.TLSState()
+	if !ok {
+		return CertificateMapping{}, false
+	}
+
+	for _, mapping := range session.server.settings.ClientCertificates {
+		if mapping.Username == username && mapping.matches(state) {
+			return mapping, true
+		}
+	}
+
+	return CertificateMapping{}, false
+}
+
+// certificateRequired reports if user is configured to log in with both certificate and password
+func (session *SessionInfo) certificateRequired(username string) bool {
+	return slices.ContainsFunc(session.server.settings.ClientCertificates, func(mapping CertificateMapping) bool {
+		return mapping.Username == username && mapping.RequirePassword
+	})
+}
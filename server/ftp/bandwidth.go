@@ -0,0 +1,100 @@
+package ftp
+
+import (
+	"server/ftp/throttle"
+)
+
+// BandwidthLimit in bytes per second, 0 means unlimited
+type BandwidthLimit struct {
+	Upload   int64
+	Download int64
+}
+
+// bandwidthLimiters are token buckets of one level (server, user or session),
+// shared by all transfers on that level
+type bandwidthLimiters struct {
+	upload   *throttle.Limiter
+	download *throttle.Limiter
+}
+
+func newBandwidthLimiters(limit BandwidthLimit) *bandwidthLimiters {
+	return &bandwidthLimiters{
+		upload:   throttle.NewLimiter(limit.Upload),
+		download: throttle.NewLimiter(limit.Download),
+	}
+}
+
+func (limiters *bandwidthLimiters) set(limit BandwidthLimit) {
+	limiters.upload.SetRate(limit.Upload)
+	limiters.download.SetRate(limit.Download)
+}
+
+// SetBandwidthLimit changes limit shared by all transfers on the server, running transfers are affected too
+func (server *FtpServer) SetBandwidthLimit(limit BandwidthLimit) {
+	server.bandwidth.set(limit)
+}
+
+// SetUserBandwidthLimit changes limit shared by all sessions of the user
+func (server *FtpServer) SetUserBandwidthLimit(username string, limit BandwidthLimit) {
+	server.userBandwidth(username).set(limit)
+}
+
+// SetSessionBandwidthLimit changes limit of every session, including the ones already connected
+func (server *FtpServer) SetSessionBandwidthLimit(limit BandwidthLimit) {
+	server.sessionsLock.Lock()
+	defer server.sessionsLock.Unlock()
+
+	server.sessionBandwidthLimit = limit
+	for session := range server.sessions {
+		session.bandwidth.set(limit)
+	}
+}
+
+// registerSession adds session to the server, so its bandwidth limit can be changed at runtime
+// and SITE WHO of other sessions can list it
+func (server *FtpServer) registerSession(session *SessionInfo) {
+	server.sessionsLock.Lock()
+	defer server.sessionsLock.Unlock()
+
+	session.bandwidth = newBandwidthLimiters(server.sessionBandwidthLimit)
+	server.sessions[session] = newPresence(session)
+}
+
+func (server *FtpServer) unregisterSession(session *SessionInfo) {
+	server.sessionsLock.Lock()
+	defer server.sessionsLock.Unlock()
+
+	delete(server.sessions, session)
+}
+
+// userBandwidth returns limiters of user, they are created from settings when user logs in first time
+func (server *FtpServer) userBandwidth(username string) *bandwidthLimiters {
+	server.sessionsLock.Lock()
+	defer server.sessionsLock.Unlock()
+
+	limiters, ok := server.usersBandwidth[username]
+	if !ok {
+		limiters = newBandwidthLimiters(server.settings.UserBandwidthLimits[username])
+		server.usersBandwidth[username] = limiters
+	}
+
+	return limiters
+}
+
+// uploadLimiters returns all limiters that apply to upload in this session
+func (session *SessionInfo) uploadLimiters() []*throttle.Limiter {
+	return []*throttle.Limiter{
+		session.server.bandwidth.upload,
+		session.server.userBandwidth(session.username).upload,
+		session.bandwidth.upload,
+	}
+}
+
+// downloadLimiters returns all limiters that apply to download in this session
+func (session *SessionInfo) downloadLimiters() []*throttle.Limiter {
+	return []*throttle.Limiter{
+		session.server.bandwidth.download,
+		session.server.userBandwidth(session.username).download,
+		session.bandwidth.download,
+	}
+}
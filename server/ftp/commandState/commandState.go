@@ -1,43 +1,131 @@
 package commandState
 
 import (
+	"context"
 	"sync"
+	"time"
 )
 
 // CommandState saves information about progress of long running command (upload/download)
 type CommandState struct {
-	AbortChan         chan bool // allows outside process to AbortChan command
-	finishedBroadcast *sync.Cond
-	running           bool
-	lock              *sync.Mutex
+	cancel      context.CancelFunc // cancels context of running command
+	done        chan struct{}      // closed when running command finishes
+	running     bool
+	completing  bool // command ended and sends its final reply, it can no longer be aborted
+	aborted     bool
+	description string // command line of running command
+	startedAt   time.Time
+	finishedAt  time.Time
+	counter     *transferCounter
+	lock        *sync.Mutex
 }
 
 func New() *CommandState {
-	return &CommandState{lock: &sync.Mutex{}, AbortChan: make(chan bool), finishedBroadcast: sync.NewCond(&sync.Mutex{}), running: false}
+	done := make(chan struct{})
+	close(done)
+
+	return &CommandState{lock: &sync.Mutex{}, cancel: func() {}, done: done, running: false, counter: &transferCounter{}}
 }
 
-func (command *CommandState) Start() {
+// Start marks command as running, returned context is canceled when command is aborted.
+// description is reported by STAT while the command runs.
+// Previous command that still sends its final reply is waited for.
+func (command *CommandState) Start(description string) context.Context {
 	command.lock.Lock()
-	// to prevent leftover AbortChan request from canceling next command
-	command.AbortChan = make(chan bool)
-	command.finishedBroadcast = sync.NewCond(command.lock)
+	defer command.lock.Unlock()
+
+	for command.running {
+		done := command.done
+		command.lock.Unlock()
+		<-done
+		command.lock.Lock()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// every command gets new context, so leftover abort can not cancel next command
+	command.cancel = cancel
+	command.done = make(chan struct{})
 	command.running = true
-	command.lock.Unlock()
+	command.completing = false
+	command.aborted = false
+	command.description = description
+	command.startedAt = time.Now()
+
+	// readers of previous command may still count, so they get their own counter
+	command.counter = &transferCounter{}
+	command.counter.total.Store(UNKNOWN_SIZE)
+
+	return ctx
+}
+
+// Complete is called when command ended, before it sends its final reply.
+// Returns false when command was aborted, replies are then sent by ABOR and command must stay silent.
+func (command *CommandState) Complete() bool {
+	command.lock.Lock()
+	defer command.lock.Unlock()
+
+	if command.aborted {
+		return false
+	}
+
+	command.completing = true
+	command.finishedAt = time.Now()
+	return true
 }
 
+// Finish marks command as finished, it is safe to call it repeatedly
 func (command *CommandState) Finish() {
 	command.lock.Lock()
-	command.running = false
-	command.lock.Unlock()
+	defer command.lock.Unlock()
 
+	if command.running {
+		command.running = false
+		command.completing = false
+		command.finishedAt = time.Now()
+		command.cancel()
+		close(command.done)
+	}
 }
 
-func (command *CommandState) Abort() {
+// Abort cancels running command and waits until it finishes.
+// Returns false if there was nothing to abort, because command is already sending its final reply or no command runs.
+func (command *CommandState) Abort() bool {
 	command.lock.Lock()
-	command.AbortChan <- true
+
+	if !command.running {
+		command.lock.Unlock()
+		return false
+	}
+
+	// waiting for completing command keeps its final reply before replies to ABOR
+	done := command.done
+	aborted := !command.completing
+	if aborted {
+		command.aborted = true
+		command.cancel()
+	}
 	command.lock.Unlock()
+
+	// command finishes quickly, canceled context interrupts its data connection
+	<-done
+
+	return aborted
 }
 
+// IsRunning reports whether command is in progress, command sending its final reply no longer counts,
+// so client can send next command right after the reply
 func (command *CommandState) IsRunning() bool {
-	return command.running
+	command.lock.Lock()
+	defer command.lock.Unlock()
+
+	return command.running && !command.completing
+}
+
+// FinishedAt returns time when last command finished, zero if no command finished yet
+func (command *CommandState) FinishedAt() time.Time {
+	command.lock.Lock()
+	defer command.lock.Unlock()
+
+	return command.finishedAt
 }
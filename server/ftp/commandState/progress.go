@@ -0,0 +1,97 @@
+package commandState
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const UNKNOWN_SIZE = -1
+
+// Progress is snapshot of running transfer, reported by STAT
+type Progress struct {
+	Description string
+	Transferred int64
+	Total       int64 // UNKNOWN_SIZE when size of transfer is not known in advance
+	Elapsed     time.Duration
+}
+
+// Rate returns average speed of transfer in bytes per second
+func (progress Progress) Rate() int64 {
+	if progress.Elapsed <= 0 {
+		return 0
+	}
+
+	return int64(float64(progress.Transferred) / progress.Elapsed.Seconds())
+}
+
+// transferCounter is shared by CommandState and reader or writer of the transfer, so it is updated without lock
+type transferCounter struct {
+	transferred atomic.Int64
+	total       atomic.Int64
+}
+
+// SetTotal sets expected size of running transfer
+func (command *CommandState) SetTotal(size int64) {
+	command.lock.Lock()
+	defer command.lock.Unlock()
+
+	command.counter.total.Store(size)
+}
+
+// CountReader counts bytes read from reader as transferred by running command
+func (command *CommandState) CountReader(reader io.Reader) io.Reader {
+	command.lock.Lock()
+	defer command.lock.Unlock()
+
+	return &countingReader{reader: reader, counter: command.counter}
+}
+
+// CountWriter counts bytes written to writer as transferred by running command
+func (command *CommandState) CountWriter(writer io.Writer) io.Writer {
+	command.lock.Lock()
+	defer command.lock.Unlock()
+
+	return &countingWriter{writer: writer, counter: command.counter}
+}
+
+// Progress returns progress of running command, false when no command runs
+func (command *CommandState) Progress() (Progress, bool) {
+	command.lock.Lock()
+	defer command.lock.Unlock()
+
+	if !command.running {
+		return Progress{}, false
+	}
+
+	return Progress{
+		Description: command.description,
+		Transferred: command.counter.transferred.Load(),
+		Total:       command.counter.total.Load(),
+		Elapsed:     time.Since(command.startedAt),
+	}, true
+}
+
+type countingReader struct {
+	reader  io.Reader
+	counter *transferCounter
+}
+
+func (counting *countingReader) Read(data []byte) (int, error) {
+	n, err := counting.reader.Read(data)
+	counting.counter.transferred.Add(int64(n))
+
+	return n, err
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	counter *transferCounter
+}
+
+func (counting *countingWriter) Write(data []byte) (int, error) {
+	n, err := counting.writer.Write(data)
+	counting.counter.transferred.Add(int64(n))
+
+	return n, err
+}
@@ -1,456 +1,803 @@
 package ftp
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"path/filepath"
+	"server/fs"
+	"server/ftp/commandState"
 	"server/ftp/connection"
+	"server/ftp/throttle"
 	"server/respones"
 	"server/sequences"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
-var publicCommands = []string{"USER", "PASS"}
+// errStoreFailed interrupts upload when filesystem can not store the file
+var errStoreFailed = errors.New("storing file failed")
 
-// handleCommand returned error means, that session is in irrecoverable state and we have to close it
+// handleCommand sends reply of command handler or its error, returned error means that session has to be closed
 func (session *SessionInfo) handleCommand(commandLine string) error {
-	log.Printf("Received command '%s'", commandLine)
+	command := parseCommand(commandLine)
 
-	command, argument, hasArguments := strings.Cut(commandLine, " ")
-	if !hasArguments {
-		command = commandLine
-	}
-
-	// only allow some commands
-	if !session.isLoggedIn && !slices.Contains(publicCommands, command) {
-		session.RespondOrPanic(respones.NotLoggedIn())
-
-		return nil
+	reply, err := session.dispatchCommand(command)
+	if err != nil {
+		reply = errorReply(err)
 	}
 
-	if session.command.IsRunning() {
-		log.Printf("trying to handle command while another is running, %s", commandLine)
-
-		switch command {
-		case "ABOR":
-
-			_ = session.handleABOR()
-
-		default:
-			// TODO use better error
-
-			// better way would be to place command in some queue to be processed later
-			session.RespondOrPanic(respones.BadSequence())
-		}
-
-		return nil
-	}
-
-	var err error
-	switch command {
-	case "USER":
-		err = session.handleUSER(argument)
-	case "PASS":
-		err = session.handlePASS(argument)
-	case "LIST":
-		err = session.handleLIST(argument)
-	case "SYST":
-		err = session.handleSYST()
-	case "FEAT":
-		err = session.handleFEAT()
-	case "PWD":
-		err = session.handlePWD()
-	case "CWD":
-		err = session.handleCWD(argument)
-	case "TYPE":
-		err = session.handleTYPE(argument)
-	case "MODE":
-		err = session.handleMODE(argument)
-	case "RETR":
-		err = session.handleRETR(argument)
-	case "EPSV":
-		err = session.handleEPSV()
-	case "PASV":
-		err = session.handlePASV()
-	case "STOR":
-		err = session.handleSTOR(argument)
-	case "QUIT":
-		err = session.handleQUIT()
-	case "ABOR":
-		err = session.handleABOR()
-	case "RNFR":
-		err = session.handleRNFR(argument)
-	case "RNTO":
-		err = session.handleRNTO(argument)
-	case "DELE":
-		err = session.handleDELE(argument)
-	case "MKD":
-		err = session.handleMKD(argument)
-	default:
-		log.Printf("Command %s is not implemented", command)
+	session.respondTo(command, reply)
+	// transfer is only started by successful command, which is also checked by reply code
+	session.startPendingTransfer(command, reply)
 
-		session.RespondOrPanic(respones.NotImplemented())
+	tlsErr := session.startPendingTLS(reply)
+	if tlsErr != nil {
+		return tlsErr
 	}
 
-	// TODO create custom error struct to separate non recoverable errors
-
-	// unrecoverable error while processing command
 	if err != nil {
-		return fmt.Errorf("unrecoverable error while handling command: %s", err)
+		if serverError := toServerError(err); serverError.ShouldTerminate() {
+			return serverError
+		}
 	}
 
 	return nil
 }
 
-func (session *SessionInfo) handleUSER(username string) error {
+func (session *SessionInfo) handleUSER(username string) (respones.Reply, error) {
+	// certificate alone is enough, PASS is skipped
+	mapping, ok := session.certificateMapping(username)
+	if ok && !mapping.RequirePassword {
+		log.Printf("user %s authenticated by client certificate", username)
+
+		err := session.login(username)
+		if err != nil {
+			return respones.Reply{}, err
+		}
 
-	session.RespondOrPanic(respones.PasswordNeeded())
+		return respones.UserLoggedInWithCertificate(), nil
+	}
 
 	session.commandSequence = sequences.NewLoginSequence(username)
-	return nil
+
+	return respones.PasswordNeeded(), nil
 }
 
-func (session *SessionInfo) handlePASS(password string) error {
+func (session *SessionInfo) handlePASS(password string) (respones.Reply, error) {
 	loginSequence, ok := session.commandSequence.(*sequences.LoginSequence)
 
 	// check sequence
 	if !ok {
-		log.Printf("wrong command sequence")
-
-		session.RespondOrPanic(respones.BadSequence())
+		return respones.Reply{}, newBadSequenceError("PASS without USER")
 	}
 
 	log.Printf("trying to authenticate user %s", loginSequence.Username)
 
+	// user has to present certificate in addition to password
+	_, hasCertificate := session.certificateMapping(loginSequence.Username)
+	if !hasCertificate && session.certificateRequired(loginSequence.Username) {
+		return respones.Reply{}, NewError(fmt.Sprintf("user %s requires client certificate", loginSequence.Username), "Not logged in / incorrect password.", 530, false)
+	}
+
 	// wrong password/username
 	if !authenticateUser(loginSequence.Username, password) {
-		log.Printf("Wrong user name or pasword")
-
-		session.RespondOrPanic(respones.NotLoggedIn())
-
-		return nil
+		return respones.Reply{}, NewError("wrong user name or password", "Not logged in / incorrect password.", 530, false)
 	}
 
 	log.Printf("user authenticated")
 
-	session.RespondOrPanic(respones.UserLoggedIn())
-
-	// login ok
-	session.username = loginSequence.Username
-	session.isLoggedIn = true
-	session.commandSequence = nil
+	err := session.login(loginSequence.Username)
+	if err != nil {
+		return respones.Reply{}, err
+	}
 
-	return nil
+	return respones.UserLoggedIn(), nil
 }
 
-func (session *SessionInfo) handleLIST(requestedPath string) error {
+func (session *SessionInfo) handleLIST(requestedPath string) (respones.Reply, error) {
 	// if no path is specified, use cwd
 	joinedPath := filepath.Join(session.cwd, requestedPath)
 
 	files, err := session.filesystem.List(joinedPath)
 	if err != nil {
-
+		return respones.Reply{}, newFileError(requestedPath, err)
 	}
 
-	printListReader := strings.NewReader(files.String())
+	listing := files.String()
 
-	// notify client that we will stand sending response
-	session.RespondOrPanic(respones.SendingResponse())
+	// listing runs in background like other transfers, so it can be aborted
+	session.runTransfer("LIST "+requestedPath, func(ctx context.Context) respones.Reply {
+		session.command.SetTotal(int64(len(listing)))
+		printListReader := session.command.CountReader(throttle.NewReader(ctx, strings.NewReader(listing), session.downloadLimiters()...))
 
-	// send data using data connection
-	err = session.dataConnection.Send(session.transmissionMode, printListReader, nil)
-	if err != nil {
-		return err
-	}
-	log.Printf("data written to data controlConnection")
+		err := session.dataConnection.WaitForDataConnection(ctx)
+		if err != nil {
+			log.Printf("Error opening data connection: %s", err)
+			return respones.CantOpenDataConnection()
+		}
 
-	// acknowledge that all data was send
-	session.RespondOrPanic(respones.FileActionOk())
-	return nil
-}
+		// send data using data connection
+		// listing is always sent as text file, TYPE and STRU only apply to RETR and STOR
+		parameters := connection.TransferParameters{
+			Type:      connection.TYPE_ASCII,
+			Format:    connection.FORMAT_NON_PRINT,
+			Mode:      session.transmissionMode,
+			Structure: connection.STRUCTURE_FILE,
+		}
+		err = session.dataConnection.Send(ctx, parameters, printListReader)
+		if err != nil {
+			log.Printf("Error sending list: %s", err)
+			return respones.TransferAborted()
+		}
+		log.Printf("data written to data controlConnection")
 
-func (session *SessionInfo) handleSYST() error {
-	session.RespondOrPanic(respones.System())
+		// acknowledge that all data was send
+		return respones.FileActionOk()
+	}, nil)
 
-	return nil
+	// notify client that we will stand sending response
+	return respones.SendingResponse(), nil
 }
 
-func (session *SessionInfo) handleFEAT() error {
-	features := []string{"SIZE"}
-
-	session.RespondOrPanic(respones.ListFeatures(features))
-
-	return nil
+func (session *SessionInfo) handleSYST() (respones.Reply, error) {
+	return respones.System(), nil
 }
 
-func (session *SessionInfo) handlePWD() error {
-	session.RespondOrPanic(respones.SendPWD(session.cwd))
+func (session *SessionInfo) handleFEAT() (respones.Reply, error) {
+	return respones.ListFeatures(session.features()), nil
+}
 
+func (session *SessionInfo) handlePWD() (respones.Reply, error) {
 	log.Printf("returned working directory")
-	return nil
+	return respones.SendPWD(session.cwd), nil
 }
 
-func (session *SessionInfo) handleTYPE(params string) error {
-	dataType, dataFormat, hasFormatSet := strings.Cut(params, " ")
+func (session *SessionInfo) handleTYPE(params string) (respones.Reply, error) {
+	// type codes are case insensitive like command names
+	dataType, dataFormat, hasFormatSet := strings.Cut(strings.ToUpper(params), " ")
 
+	var newType connection.DataType
 	switch dataType {
 	case "A":
-		session.dataType = connection.TYPE_ASCII
+		newType = connection.TYPE_ASCII
 	case "E":
-		session.dataType = connection.TYPE_EBCDIC
+		newType = connection.TYPE_EBCDIC
 	case "I":
-		session.dataType = connection.TYPE_IMAGE
+		newType = connection.TYPE_IMAGE
 	case "L":
-		// TODO return some unsupported error
-		session.dataType = connection.TYPE_LOCAL
+		// only 8 bit bytes are supported, which is the same as image type
+		if !hasFormatSet {
+			return respones.Reply{}, newSyntaxError("TYPE L without byte size")
+		}
+		if dataFormat != "8" {
+			return respones.Reply{}, newUnsupportedParameterError(fmt.Sprintf("byte size %s not supported", dataFormat))
+		}
+		newType = connection.TYPE_LOCAL
 	default:
-		return errors.New("data type not supported")
+		return respones.Reply{}, newUnsupportedParameterError(fmt.Sprintf("data type %s not supported", dataType))
 	}
 
-	if hasFormatSet && (session.dataType == connection.TYPE_ASCII || session.dataType == connection.TYPE_EBCDIC) {
+	// format defaults to non print, when it is not specified
+	newFormat := connection.FORMAT_NON_PRINT
+	if hasFormatSet && (newType == connection.TYPE_ASCII || newType == connection.TYPE_EBCDIC) {
 		switch dataFormat {
 		case "N":
-			session.dataFormat = connection.FORMAT_NON_PRINT
+			newFormat = connection.FORMAT_NON_PRINT
 		case "T":
-			session.dataFormat = connection.FORMAT_TELNET
+			newFormat = connection.FORMAT_TELNET
 		case "C":
-			session.dataFormat = connection.FORMAT_ASA
+			newFormat = connection.FORMAT_ASA
 		default:
-			return errors.New("data format not supported")
+			return respones.Reply{}, newUnsupportedParameterError(fmt.Sprintf("data format %s not supported", dataFormat))
 		}
 	}
 
-	session.RespondOrPanic(respones.CommandOkay())
+	session.dataType = newType
+	session.dataFormat = newFormat
 
-	return nil
+	return respones.CommandOkay(), nil
 }
 
-func (session *SessionInfo) handleCWD(argument string) error {
+func (session *SessionInfo) handleCWD(argument string) (respones.Reply, error) {
 	// TODO do some validation
 	session.cwd = argument
 
 	log.Printf("CWD changed to %s", session.cwd)
 
-	session.RespondOrPanic(respones.FileActionOk())
-
-	return nil
+	return respones.FileActionOk(), nil
 }
 
-func (session *SessionInfo) handleMODE(argument string) error {
-	switch argument {
+func (session *SessionInfo) handleMODE(argument string) (respones.Reply, error) {
+	switch strings.ToUpper(argument) {
 	case "S":
 		session.transmissionMode = connection.MODE_STREAM
 	case "B":
 		session.transmissionMode = connection.MODE_BLOCK
 	case "C":
-		session.transmissionMode = connection.MODE_COMPRESSED
+		// compressed mode is recognized, but data can not be compressed
+		return respones.Reply{}, newUnsupportedParameterError("compressed mode not supported")
 	default:
-		return fmt.Errorf("")
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("unknown mode %s", argument))
 	}
 
-	session.RespondOrPanic(respones.CommandOkay())
-
-	return nil
+	return respones.CommandOkay(), nil
 }
 
-func (session *SessionInfo) handleRETR(requestedPath string) error {
-	// TODO handle resume
+func (session *SessionInfo) handleSTRU(argument string) (respones.Reply, error) {
+	switch strings.ToUpper(argument) {
+	case "F":
+		session.fileStructure = connection.STRUCTURE_FILE
+	case "R":
+		session.fileStructure = connection.STRUCTURE_RECORD
+	case "P":
+		// page structure is recognized, but files can not be transferred in pages
+		return respones.Reply{}, newUnsupportedParameterError("page structure not supported")
+	default:
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("unknown structure %s", argument))
+	}
+
+	return respones.CommandOkay(), nil
+}
 
+func (session *SessionInfo) handleRETR(requestedPath string) (respones.Reply, error) {
 	joinedPath := filepath.Join(session.cwd, requestedPath)
 
+	// REST only applies to the command right after it
+	restartOffset := session.restartOffset
+	session.restartOffset = 0
+
+	fileReader, err := session.filesystem.Retrieve(joinedPath)
+	if err != nil {
+		return respones.Reply{}, newFileError(requestedPath, err)
+	}
+
+	localOffset, err := session.localRestartOffset(joinedPath, restartOffset)
+	if err == nil && localOffset > 0 {
+		err = skipToOffset(fileReader, localOffset)
+	}
+	if err != nil {
+		closeReader(fileReader)
+
+		if errors.Is(err, errInvalidRestartOffset) {
+			return respones.Reply{}, NewError(fmt.Sprintf("restarting transfer at %d", restartOffset), "Requested action not taken: invalid REST parameter.", 554, false).wrap(err)
+		}
+		return respones.Reply{}, newFileError(requestedPath, err)
+	}
+
+	log.Printf("filereader retrieved, sending file...")
+
 	// if command would not close, session would be locked until abort is issued
-	session.command.Start()
+	session.runTransfer("RETR "+requestedPath, func(ctx context.Context) respones.Reply {
+		defer closeReader(fileReader)
+
+		// size is only known for readers backed by real file
+		if info, ok := statFile(fileReader); ok {
+			session.command.SetTotal(info.Size() - localOffset)
+		}
 
-	go func() {
+		err := session.dataConnection.WaitForDataConnection(ctx)
+		if err != nil {
+			log.Printf("Error opening data connection: %s", err)
+			return respones.CantOpenDataConnection()
+		}
 
-		defer func() {
-			if err := recover(); err != nil {
-				log.Printf("PANIC: runing goroutine for sending file: %s", err)
-			}
-			log.Printf("async task defer")
-			// TODO maybe abort whole session
-			session.command.Finish()
-		}()
+		throttledReader := session.command.CountReader(throttle.NewReader(ctx, fileReader, session.downloadLimiters()...))
 
-		fileReader, err := session.filesystem.Retrieve(joinedPath)
+		err = session.dataConnection.Send(ctx, session.transferParameters(), throttledReader)
 		if err != nil {
-			log.Printf("Error getting reader for file: %s", err)
-			session.RespondOrPanic(respones.FileUnavailable(requestedPath))
-			return
+			log.Printf("Error sending file: %s", err)
+			return respones.TransferAborted()
 		}
 
-		log.Printf("filereader retrieved, sending file...")
+		return respones.DataSendClosingConnection()
+	}, func() {
+		closeReader(fileReader)
+	})
+
+	return respones.SendingResponse(), nil
+}
+
+// handleSIZE returns size of file as it would be transferred in current TYPE (RFC 3659)
+func (session *SessionInfo) handleSIZE(requestedPath string) (respones.Reply, error) {
+	joinedPath := filepath.Join(session.cwd, requestedPath)
+
+	size, err := session.transferSize(joinedPath)
+	if err != nil {
+		return respones.Reply{}, newFileError(requestedPath, err)
+	}
 
-		session.RespondOrPanic(respones.SendingResponse())
+	return respones.FileSize(size), nil
+}
+
+// TIME_VAL_FORMAT is time-val of RFC 3659 used by MDTM, MFMT and SITE UTIME, times are in UTC,
+// fraction of second is accepted when parsing
+const TIME_VAL_FORMAT = "20060102150405"
 
-		err = session.dataConnection.Send(session.transmissionMode, fileReader, session.command.AbortChan)
+// handleMDTM returns modification time of file, "MDTM <time-val> <pathname>" sets it like MFMT
+func (session *SessionInfo) handleMDTM(argument string) (respones.Reply, error) {
+	if modTime, requestedPath, ok := parseModTimeArgument(argument); ok {
+		err := session.setModTime(requestedPath, modTime)
 		if err != nil {
-			log.Printf("Error sending file: %s", err)
-			session.RespondOrPanic(respones.GenericError())
-			return
+			return respones.Reply{}, err
 		}
 
-		session.RespondOrPanic(respones.DataSendClosingConnection())
+		return respones.ModificationTime(modTime.Format(TIME_VAL_FORMAT)), nil
+	}
+
+	joinedPath := filepath.Join(session.cwd, argument)
+	modTime, err := session.fileModTime(joinedPath)
+	if err != nil {
+		return respones.Reply{}, newFileError(argument, err)
+	}
+
+	return respones.ModificationTime(modTime.UTC().Format(TIME_VAL_FORMAT)), nil
+}
 
-	}()
+// handleMFMT sets modification time of file, "<time-val> <pathname>"
+func (session *SessionInfo) handleMFMT(argument string) (respones.Reply, error) {
+	modTime, requestedPath, ok := parseModTimeArgument(argument)
+	if !ok {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid MFMT argument %s", argument))
+	}
+
+	err := session.setModTime(requestedPath, modTime)
+	if err != nil {
+		return respones.Reply{}, err
+	}
+
+	return respones.ModificationTimeSet(modTime.Format(TIME_VAL_FORMAT), requestedPath), nil
+}
+
+// parseModTimeArgument parses "<time-val> <pathname>", false means argument is not in this form
+func parseModTimeArgument(argument string) (time.Time, string, bool) {
+	timeValue, requestedPath, _ := strings.Cut(argument, " ")
+	if requestedPath == "" {
+		return time.Time{}, "", false
+	}
+
+	modTime, err := time.ParseInLocation(TIME_VAL_FORMAT, timeValue, time.UTC)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	return modTime, requestedPath, true
+}
+
+// setModTime changes modification time of file, if filesystem of the session supports it
+func (session *SessionInfo) setModTime(requestedPath string, modTime time.Time) error {
+	modTimeSetter, ok := session.filesystem.(fs.ModTimeSetter)
+	if !ok {
+		return NewError("filesystem does not support setting of modification time", "Command not implemented.", 502, false)
+	}
+
+	joinedPath := filepath.Join(session.cwd, requestedPath)
+	err := modTimeSetter.SetModTime(joinedPath, modTime)
+	if err != nil {
+		return newFileError(requestedPath, err)
+	}
 
 	return nil
 }
 
-func (session *SessionInfo) handlePASV() error {
+// handleREST sets offset for next RETR, offset counts bytes as they are transferred in current TYPE
+func (session *SessionInfo) handleREST(argument string) (respones.Reply, error) {
+	offset, err := strconv.ParseInt(argument, 10, 64)
+	if err != nil || offset < 0 {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid restart offset %s", argument))
+	}
+
+	// only REST STREAM is supported, other modes would need restart markers
+	if session.transmissionMode != connection.MODE_STREAM || session.fileStructure != connection.STRUCTURE_FILE {
+		return respones.Reply{}, newUnsupportedParameterError("restart is only supported in stream mode with file structure")
+	}
+
+	session.restartOffset = offset
+	return respones.RestartingAt(offset), nil
+}
+
+func (session *SessionInfo) handlePASV() (respones.Reply, error) {
 	log.Printf("passive controlConnection requested")
-	dataConn, err := connection.OpenPassiveDataConnection()
+
+	// PASV reply can only carry IPv4 address, clients on IPv6 have to use EPSV
+	localIP := session.controlConnection.LocalIP().To4()
+	if localIP == nil {
+		return respones.Reply{}, NewError("PASV on IPv6 connection", "PASV is only supported on IPv4, use EPSV.", 522, false)
+	}
+
+	dataConn, err := connection.OpenPassiveDataConnection(session.dataConnectionSettings())
 	if err != nil {
-		return fmt.Errorf("error opening data controlConnection: %s", err)
+		return respones.Reply{}, NewError("opening passive data connection", "Can't open data connection.", 425, false).wrap(err)
 	}
 	// listener started
-	session.dataConnection = dataConn
+	session.replaceDataConnection(dataConn)
 
-	return nil
+	return respones.PassiveMode(dataConn.FormatAddressForPASV(localIP)), nil
 }
 
-func (session *SessionInfo) handleEPSV() error {
+func (session *SessionInfo) handleEPSV() (respones.Reply, error) {
 	log.Printf("Extended passive mode requested")
-	dataConn, err := connection.OpenPassiveDataConnection()
+	dataConn, err := connection.OpenPassiveDataConnection(session.dataConnectionSettings())
 	if err != nil {
-		return fmt.Errorf("error opening data controlConnection: %s", err)
+		return respones.Reply{}, NewError("opening passive data connection", "Can't open data connection.", 425, false).wrap(err)
 	}
 	// listener started
-	session.dataConnection = dataConn
+	session.replaceDataConnection(dataConn)
 
 	log.Printf("Data conneciton listener started")
 	// send port to listened on
-	session.RespondOrPanic(respones.EPSVEnabled(dataConn.Port()))
+	return respones.EPSVEnabled(dataConn.Port()), nil
+}
 
-	return nil
+func (session *SessionInfo) handlePORT(argument string) (respones.Reply, error) {
+	address, err := connection.ParsePORTAddress(argument)
+	if err != nil {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid PORT argument %s", argument)).wrap(err)
+	}
+
+	return session.openActiveDataConnection(address)
 }
 
-func (session *SessionInfo) handleSTOR(destination string) error {
-	session.RespondOrPanic(respones.StartUpload())
+func (session *SessionInfo) handleEPRT(argument string) (respones.Reply, error) {
+	address, err := connection.ParseEPRTAddress(argument)
+	if errors.Is(err, connection.ErrUnsupportedNetworkProtocol) {
+		return respones.Reply{}, NewError(fmt.Sprintf("unsupported EPRT protocol %s", argument), "Network protocol not supported, use (1,2)", 522, false)
+	}
+	if err != nil {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid EPRT argument %s", argument)).wrap(err)
+	}
 
-	// TODO save to temp file
-	uploadBuffer := new(bytes.Buffer)
+	return session.openActiveDataConnection(address)
+}
 
-	log.Printf("start receiving data...")
+// openActiveDataConnection checks address against bounce attacks (RFC 2577) and uses it for next transfer
+func (session *SessionInfo) openActiveDataConnection(address *net.TCPAddr) (respones.Reply, error) {
+	// privileged ports are refused even for FXP users
+	if address.Port < 1024 {
+		return respones.Reply{}, newUnsupportedParameterError(fmt.Sprintf("refusing active data connection to privileged port %s", address))
+	}
 
-	err := session.dataConnection.Receive(session.transmissionMode, uploadBuffer)
-	if err != nil {
-		log.Printf("Error processing:  %s", err)
-		session.RespondOrPanic(respones.TransferAborted())
+	if !address.IP.Equal(session.controlConnection.RemoteIP()) && !slices.Contains(session.server.settings.FXPUsers, session.username) {
+		return respones.Reply{}, newUnsupportedParameterError(fmt.Sprintf("refusing active data connection to %s, it is not control connection peer", address))
 	}
 
-	log.Printf("data received")
+	session.replaceDataConnection(connection.OpenActiveDataConnection(address, session.dataConnectionSettings()))
+
+	log.Printf("active data connection to %s prepared", address)
+	return respones.CommandOkay(), nil
+}
+
+func (session *SessionInfo) handleSTOR(destination string) (respones.Reply, error) {
+	joinedPath := filepath.Join(session.cwd, destination)
+
+	// uploads are stored atomically, so they can not continue partially stored file
+	if session.restartOffset != 0 {
+		session.restartOffset = 0
+		return respones.Reply{}, NewError("restarting upload", "Requested action not taken: invalid REST parameter.", 554, false)
+	}
+
+	// upload runs in background like download, so ABOR can be processed
+	session.runTransfer("STOR "+destination, func(ctx context.Context) respones.Reply {
+		err := session.dataConnection.WaitForDataConnection(ctx)
+		if err != nil {
+			log.Printf("Error opening data connection: %s", err)
+			return respones.CantOpenDataConnection()
+		}
+
+		log.Printf("start receiving data...")
+
+		// data are streamed from the data connection directly to the filesystem
+		uploadReader, uploadWriter := io.Pipe()
+		receiveErrChan := make(chan error, 1)
+
+		go func() {
+			throttledWriter := session.command.CountWriter(throttle.NewWriter(ctx, uploadWriter, session.uploadLimiters()...))
+
+			err := session.dataConnection.Receive(ctx, session.transferParameters(), throttledWriter)
+			// nil error closes pipe with EOF, which finishes the file
+			_ = uploadWriter.CloseWithError(err)
+			receiveErrChan <- err
+		}()
+
+		storeErr := session.filesystem.Store(joinedPath, uploadReader)
+		// when store fails first, receiving is interrupted by closed pipe
+		_ = uploadReader.CloseWithError(errStoreFailed)
+		receiveErr := <-receiveErrChan
+
+		if receiveErr != nil && !errors.Is(receiveErr, errStoreFailed) {
+			log.Printf("Error processing:  %s", receiveErr)
+			return respones.TransferAborted()
+		}
+
+		if storeErr != nil {
+			return errorReply(newStoreError(destination, storeErr))
+		}
+
+		log.Printf("File saved to fs succesfully")
+		return respones.FileActionOk()
+	}, nil)
+
+	return respones.StartUpload(), nil
+}
+
+// handleQUIT closes session after the reply
+func (session *SessionInfo) handleQUIT() (respones.Reply, error) {
+	return respones.Reply{}, NewError("client quit", "Closing control connection, Goodbye", 221, true)
+}
 
-	err = session.filesystem.Store(destination, uploadBuffer)
+func (session *SessionInfo) handleABOR() (respones.Reply, error) {
+	log.Printf("ABOR command received")
+
+	// Abort waits until transfer stops, so 426 always comes after its last reply.
+	// 426 finishes the aborted transfer, ABOR itself is answered by the returned reply
+	if session.command.Abort() {
+		session.respondTo(session.transferCommand, respones.TransferAborted())
+	}
+
+	return respones.DataSendClosingConnection(), nil
+}
+
+func (session *SessionInfo) handleSTAT(argument string) (respones.Reply, error) {
+	if argument != "" {
+		return session.handleSTATPath(argument)
+	}
+
+	progress, running := session.command.Progress()
+	if running {
+		return respones.TransferStatus(transferStatus(progress)), nil
+	}
+
+	return respones.ServerStatus(session.status()), nil
+}
+
+// handleSTATPath sends directory listing over control connection, so no data connection is needed
+func (session *SessionInfo) handleSTATPath(requestedPath string) (respones.Reply, error) {
+	joinedPath := filepath.Join(session.cwd, requestedPath)
+
+	files, err := session.filesystem.List(joinedPath)
 	if err != nil {
-		log.Printf("Error storing file: %s", err)
+		return respones.Reply{}, newFileError(requestedPath, err)
+	}
 
-		session.RespondOrPanic(respones.GenericError())
+	lines := make([]string, len(files))
+	for idx, file := range files {
+		lines[idx] = strings.TrimSpace(file.String())
 	}
 
-	log.Printf("File saved to fs succesfully")
-	session.RespondOrPanic(respones.FileActionOk())
-	return nil
+	return respones.FileStatus(requestedPath, lines), nil
 }
 
-func (session *SessionInfo) handleQUIT() error {
-	session.RespondOrPanic(respones.ClosingControlConnection())
+// status describes session for STAT without argument
+func (session *SessionInfo) status() []string {
+	lines := []string{
+		fmt.Sprintf("Connected from %s", session.controlConnection.RemoteIP()),
+		fmt.Sprintf("Logged in as %s", session.username),
+		fmt.Sprintf("Working directory %s", session.cwd),
+		fmt.Sprintf("TYPE: %s, FORM: %s, STRU: %s, MODE: %s", session.dataType, session.dataFormat, session.fileStructure, session.transmissionMode),
+		fmt.Sprintf("EBCDIC codepage %s", session.codepage.Name),
+	}
 
-	return nil
+	if tlsState, ok := session.controlConnection.TLSState(); ok {
+		lines = append(lines, fmt.Sprintf("Control connection protected by %s", tls.VersionName(tlsState.Version)))
+	} else {
+		lines = append(lines, "Control connection not protected")
+	}
+
+	lines = append(lines, session.dataConnection.Status(), "No transfer in progress")
+
+	return lines
 }
 
-func (session *SessionInfo) handleABOR() error {
-	log.Printf("ABOR command received")
+// transferStatus describes progress of running transfer for STAT
+func transferStatus(progress commandState.Progress) []string {
+	transferred := fmt.Sprintf("Transferred %d bytes", progress.Transferred)
+	if progress.Total > 0 {
+		transferred = fmt.Sprintf("Transferred %d of %d bytes (%d%%)", progress.Transferred, progress.Total, progress.Transferred*100/progress.Total)
+	}
 
-	if session.command.IsRunning() {
-		session.command.Abort()
+	return []string{
+		progress.Description,
+		transferred,
+		fmt.Sprintf("Rate %d bytes/s, running for %s", progress.Rate(), progress.Elapsed.Round(time.Second)),
+	}
+}
+
+func (session *SessionInfo) handleNOOP() (respones.Reply, error) {
+	return respones.CommandOkay(), nil
+}
 
-		session.RespondOrPanic(respones.TransferAborted())
+func (session *SessionInfo) handleHELP(argument string) (respones.Reply, error) {
+	if argument == "" {
+		return respones.Help(commandNames()), nil
 	}
 
-	session.RespondOrPanic(respones.DataSendClosingConnection())
+	command := strings.ToUpper(argument)
+	spec, ok := commands[command]
+	if !ok {
+		return respones.Reply{}, NewError(fmt.Sprintf("help for unknown command %s", command), fmt.Sprintf("Unknown command %s.", command), 502, false)
+	}
 
-	return nil
+	return respones.HelpCommand(spec.help), nil
 }
 
-func (session *SessionInfo) handleRNFR(renameFromPath string) error {
+// handleSuperfluous accepts command that has no effect on this server
+func (session *SessionInfo) handleSuperfluous() (respones.Reply, error) {
+	return respones.CommandSuperfluous(), nil
+}
+
+// handleALLO checks if upload of given size fits on the filesystem, space is not reserved
+func (session *SessionInfo) handleALLO(argument string) (respones.Reply, error) {
+	size, err := parseALLOArgument(argument)
+	if err != nil {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid ALLO argument %s", argument)).wrap(err)
+	}
+
+	spaceReporter, ok := session.filesystem.(fs.SpaceReporter)
+	if !ok {
+		return respones.CommandSuperfluous(), nil
+	}
+
+	available, err := spaceReporter.AvailableSpace(session.cwd)
+	if err != nil {
+		log.Printf("cannot check available space: %s", err)
+		return respones.CommandSuperfluous(), nil
+	}
+
+	if size > available {
+		return respones.Reply{}, NewError(fmt.Sprintf("ALLO of %d bytes refused, only %d bytes available", size, available), "Requested file action aborted. Exceeded storage allocation.", 552, false)
+	}
+
+	return respones.CommandOkay(), nil
+}
+
+// parseALLOArgument parses "<size> [R <record size>]", record size is not used
+func parseALLOArgument(argument string) (int64, error) {
+	fields := strings.Fields(argument)
+	if len(fields) != 1 && !(len(fields) == 3 && fields[1] == "R") {
+		return 0, fmt.Errorf("expected <size> [R <record size>]")
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %s", fields[0])
+	}
+
+	if len(fields) == 3 {
+		_, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid record size %s", fields[2])
+		}
+	}
+
+	return size, nil
+}
+
+// handleREIN logs user out and resets session to the state after connecting, control connection stays open
+func (session *SessionInfo) handleREIN() (respones.Reply, error) {
+	session.reinitialize()
+
+	return respones.ServerReady(), nil
+}
+
+func (session *SessionInfo) handleRNFR(renameFromPath string) (respones.Reply, error) {
 
 	exists, err := session.filesystem.Exists(renameFromPath)
 	if err != nil {
-		log.Printf("fs exists error: %s", err)
-		session.RespondOrPanic(respones.GenericError())
+		return respones.Reply{}, newFileError(renameFromPath, err)
 	}
 
 	// validate path exists
 	if !exists {
-		session.RespondOrPanic(respones.FileUnavailable(renameFromPath))
-		return nil
+		return respones.Reply{}, newFileError(renameFromPath, fs.NewNotFoundError(renameFromPath))
 	}
 
 	session.commandSequence = sequences.NewRenameSequence(renameFromPath)
 
-	session.RespondOrPanic(respones.PendingFurtherAction("rnto"))
-
-	return nil
+	return respones.PendingFurtherAction("rnto"), nil
 }
 
-func (session *SessionInfo) handleRNTO(renameToPath string) error {
+func (session *SessionInfo) handleRNTO(renameToPath string) (respones.Reply, error) {
 	renameSequence, ok := session.commandSequence.(*sequences.RenameSequence)
 
 	// check sequence
 	if !ok {
-		log.Printf("wrong command sequence")
-
-		session.RespondOrPanic(respones.BadSequence())
+		return respones.Reply{}, newBadSequenceError("RNTO without RNFR")
 	}
 
+	// failed rename has to be started again by RNFR
+	session.commandSequence = nil
+
 	err := session.filesystem.Rename(renameSequence.RenameFromPath, renameToPath)
 	if err != nil {
-		log.Printf("Error renaming file: %s", err)
+		return respones.Reply{}, newStoreError(renameToPath, err)
+	}
 
-		session.RespondOrPanic(respones.GenericError())
+	return respones.FileActionOk(), nil
+}
 
-		return nil
-	}
+func (session *SessionInfo) handleDELE(deletePath string) (respones.Reply, error) {
 
-	session.RespondOrPanic(respones.FileActionOk())
+	err := session.filesystem.Delete(deletePath)
+	if err != nil {
+		return respones.Reply{}, newFileError(deletePath, err)
+	}
 
 	session.commandSequence = nil
 
-	return nil
+	return respones.FileActionOk(), nil
 }
 
-func (session *SessionInfo) handleDELE(deletePath string) error {
+func (session *SessionInfo) handleMKD(deletePath string) (respones.Reply, error) {
 
-	err := session.filesystem.Delete(deletePath)
+	err := session.filesystem.CreateDirectory(deletePath)
 	if err != nil {
-		log.Printf("Error deleting file: %s", err)
-		session.RespondOrPanic(respones.GenericError())
-
+		return respones.Reply{}, newStoreError(deletePath, err)
 	}
 
-	session.RespondOrPanic(respones.FileActionOk())
-
 	session.commandSequence = nil
 
-	return nil
+	return respones.FileActionOk(), nil
 }
 
-func (session *SessionInfo) handleMKD(deletePath string) error {
+// handleAUTH accepts AUTH TLS, control connection is protected after the reply is sent
+func (session *SessionInfo) handleAUTH(mechanism string) (respones.Reply, error) {
+	if session.tlsConfig == nil {
+		return respones.Reply{}, NewError("AUTH without TLS configuration", "Command not implemented.", 502, false)
+	}
 
-	err := session.filesystem.CreateDirectory(deletePath)
-	if err != nil {
-		log.Printf("Error creating directory: %s", err)
-		session.RespondOrPanic(respones.GenericError())
+	if session.controlConnection.IsTLS() {
+		return respones.Reply{}, newBadSequenceError("AUTH on protected connection")
+	}
 
+	// credentials would have been sent in plain text already
+	if session.isLoggedIn || session.commandSequence != nil {
+		return respones.Reply{}, newBadSequenceError("AUTH after login started")
 	}
 
-	session.RespondOrPanic(respones.FileActionOk())
+	switch strings.ToUpper(mechanism) {
+	case "TLS", "TLS-C", "SSL":
+		session.startTLS = true
+		return respones.SecurityExchangeOkay(), nil
+	default:
+		return respones.Reply{}, NewError(fmt.Sprintf("unsupported security mechanism %s", mechanism), "Security mechanism not understood.", 504, false)
+	}
+}
 
-	session.commandSequence = nil
+func (session *SessionInfo) handlePBSZ(argument string) (respones.Reply, error) {
+	// PBSZ is only meaningful on protected control connection
+	if !session.controlConnection.IsTLS() {
+		return respones.Reply{}, newBadSequenceError("PBSZ on unprotected connection")
+	}
 
-	return nil
+	// TLS is stream protocol, so the only buffer size is 0
+	return respones.ProtectionBufferSize(), nil
+}
+
+func (session *SessionInfo) handlePROT(level string) (respones.Reply, error) {
+	if !session.controlConnection.IsTLS() {
+		return respones.Reply{}, newBadSequenceError("PROT on unprotected connection")
+	}
+
+	switch strings.ToUpper(level) {
+	case "P":
+		session.protectData = true
+		return respones.CommandOkay(), nil
+	case "C":
+		// implicit FTPS always protects data connection
+		if session.server.settings.ImplicitTLS {
+			return respones.Reply{}, NewError("clear data connection refused", "Request denied for policy reasons.", 534, false)
+		}
+		session.protectData = false
+		return respones.CommandOkay(), nil
+	case "S", "E":
+		return respones.Reply{}, NewError(fmt.Sprintf("protection level %s not supported", level), "Requested PROT level not supported by mechanism.", 536, false)
+	default:
+		return respones.Reply{}, newUnsupportedParameterError(fmt.Sprintf("unknown protection level %s", level))
+	}
 }
@@ -0,0 +1,199 @@
+package connection
+
+import (
+	"bufio"
+	"io"
+)
+
+// ASA format (Fortran carriage control) starts every line with control character,
+// which tells the printer how to advance paper before the line is printed.
+// Local files are plain text, blank lines, form feeds and overprinting CR are converted to control characters.
+const (
+	ASA_SINGLE_SPACE = ' '
+	ASA_DOUBLE_SPACE = '0'
+	ASA_TRIPLE_SPACE = '-'
+	ASA_NEW_PAGE     = '1'
+	ASA_OVERPRINT    = '+'
+)
+
+// asaEncoder converts local text to lines with ASA control characters
+type asaEncoder struct {
+	encoder
+	atLineStart bool
+	advance     int // lines paper has to advance before next line is printed
+	translated  []byte
+}
+
+func newASAEncoder(next encoder) *asaEncoder {
+	return &asaEncoder{encoder: next, atLineStart: true, advance: 1}
+}
+
+func (asa *asaEncoder) Write(data []byte) (int, error) {
+	asa.translated = asa.translated[:0]
+
+	for _, value := range data {
+		if asa.atLineStart {
+			switch value {
+			case '\n':
+				// blank line is part of advance of next printed line
+				asa.advance++
+				continue
+			case '\f':
+				asa.appendBlankLines(asa.advance - 1)
+				asa.translated = append(asa.translated, ASA_NEW_PAGE)
+				asa.atLineStart = false
+				continue
+			}
+
+			asa.appendControl()
+			asa.atLineStart = false
+		}
+
+		switch value {
+		case '\n':
+			asa.translated = append(asa.translated, '\n')
+			asa.atLineStart = true
+			asa.advance = 1
+		case '\r':
+			// rest of the line is printed over its beginning
+			asa.translated = append(asa.translated, '\n', ASA_OVERPRINT)
+		default:
+			asa.translated = append(asa.translated, value)
+		}
+	}
+
+	_, err := asa.encoder.Write(asa.translated)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// appendControl starts line with control character matching advance, longer advance needs blank lines
+func (asa *asaEncoder) appendControl() {
+	switch {
+	case asa.advance <= 1:
+		asa.translated = append(asa.translated, ASA_SINGLE_SPACE)
+	case asa.advance == 2:
+		asa.translated = append(asa.translated, ASA_DOUBLE_SPACE)
+	default:
+		asa.appendBlankLines(asa.advance - 3)
+		asa.translated = append(asa.translated, ASA_TRIPLE_SPACE)
+	}
+}
+
+func (asa *asaEncoder) appendBlankLines(count int) {
+	for line := 0; line < count; line++ {
+		asa.translated = append(asa.translated, ASA_SINGLE_SPACE, '\n')
+	}
+}
+
+func (asa *asaEncoder) finish() error {
+	asa.translated = asa.translated[:0]
+
+	if !asa.atLineStart {
+		// last line without line ending
+		asa.translated = append(asa.translated, '\n')
+	} else {
+		// blank lines at the end of file
+		asa.appendBlankLines(asa.advance - 1)
+	}
+
+	_, err := asa.encoder.Write(asa.translated)
+	if err != nil {
+		return err
+	}
+
+	return asa.encoder.finish()
+}
+
+// asaDecoder converts lines with ASA control characters to local text
+type asaDecoder struct {
+	reader        *bufio.Reader
+	atLineStart   bool
+	firstLine     bool
+	hasLines      bool
+	endOfFile     bool
+	pendingOutput []byte // advance that did not fit into previous read
+}
+
+func newASADecoder(reader io.Reader) *asaDecoder {
+	return &asaDecoder{reader: bufio.NewReaderSize(reader, CHUNK_SIZE), atLineStart: true, firstLine: true}
+}
+
+func (asa *asaDecoder) Read(data []byte) (int, error) {
+	n := copy(data, asa.pendingOutput)
+	asa.pendingOutput = asa.pendingOutput[n:]
+
+	for n < len(data) && len(asa.pendingOutput) == 0 {
+		if asa.endOfFile {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
+		}
+
+		// only block when nothing was converted yet
+		if n > 0 && asa.reader.Buffered() == 0 {
+			break
+		}
+
+		value, err := asa.reader.ReadByte()
+		if err == io.EOF {
+			asa.endOfFile = true
+			// last line is ended by local line ending
+			if asa.hasLines {
+				asa.pendingOutput = []byte{'\n'}
+			}
+		} else if err != nil {
+			return n, err
+		} else if asa.atLineStart {
+			asa.atLineStart = value == '\n'
+			asa.pendingOutput = asa.advance(value)
+			asa.hasLines = true
+		} else if value == '\n' {
+			asa.atLineStart = true
+		} else {
+			data[n] = value
+			n++
+			continue
+		}
+
+		copied := copy(data[n:], asa.pendingOutput)
+		asa.pendingOutput = asa.pendingOutput[copied:]
+		n += copied
+	}
+
+	return n, nil
+}
+
+// advance returns local text that moves to the line with control character,
+// first line starts at the top, so it does not need line ending
+func (asa *asaDecoder) advance(control byte) []byte {
+	var output []byte
+
+	switch control {
+	case ASA_OVERPRINT:
+		output = []byte{'\r'}
+	case ASA_NEW_PAGE:
+		output = []byte{'\n', '\f'}
+	case ASA_DOUBLE_SPACE:
+		output = []byte{'\n', '\n'}
+	case ASA_TRIPLE_SPACE:
+		output = []byte{'\n', '\n', '\n'}
+	default:
+		// unknown control character is taken as single space
+		output = []byte{'\n'}
+	}
+
+	if asa.firstLine {
+		asa.firstLine = false
+		if control == ASA_OVERPRINT {
+			return nil
+		}
+		return output[1:]
+	}
+
+	return output
+}
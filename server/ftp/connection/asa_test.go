@@ -0,0 +1,167 @@
+package connection
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestASARoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  []string
+		wire    string
+		decoded string
+	}{
+		{name: "single space", chunks: []string{"a\nb\n"}, wire: " a\n b\n", decoded: "a\nb\n"},
+		{name: "blank line is double space", chunks: []string{"a\n\nb\n"}, wire: " a\n0b\n", decoded: "a\n\nb\n"},
+		{name: "two blank lines are triple space", chunks: []string{"a\n\n\nb\n"}, wire: " a\n-b\n", decoded: "a\n\n\nb\n"},
+		{name: "longer run of blank lines", chunks: []string{"a\n\n\n\n\nb\n"}, wire: " a\n \n \n-b\n", decoded: "a\n\n\n\n\nb\n"},
+		{name: "blank lines split across writes", chunks: []string{"a\n", "\n", "\n", "b\n"}, wire: " a\n-b\n", decoded: "a\n\n\nb\n"},
+		{name: "form feed is new page", chunks: []string{"a\n\fb\n"}, wire: " a\n1b\n", decoded: "a\n\fb\n"},
+		{name: "blank lines before form feed", chunks: []string{"a\n\n\fb\n"}, wire: " a\n \n1b\n", decoded: "a\n\n\fb\n"},
+		{name: "CR is overprint", chunks: []string{"ab\rcd\n"}, wire: " ab\n+cd\n", decoded: "ab\rcd\n"},
+		{name: "first line starts with form feed", chunks: []string{"\fa\n"}, wire: "1a\n", decoded: "\fa\n"},
+		{name: "first line after blank lines", chunks: []string{"\n\na\n"}, wire: "-a\n", decoded: "\n\na\n"},
+		{name: "first line after one blank line", chunks: []string{"\na\n"}, wire: "0a\n", decoded: "\na\n"},
+		{name: "blank lines at end of file", chunks: []string{"a\n\n\n"}, wire: " a\n \n \n", decoded: "a\n\n\n"},
+		{name: "last line without line ending", chunks: []string{"a\nb"}, wire: " a\n b\n", decoded: "a\nb\n"},
+		{name: "empty file", wire: "", decoded: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wire := &bytes.Buffer{}
+			asaEncoder := newASAEncoder(&streamFileEncoder{Writer: wire})
+
+			for _, chunk := range test.chunks {
+				_, err := asaEncoder.Write([]byte(chunk))
+				if err != nil {
+					t.Fatalf("encoding: %s", err)
+				}
+			}
+			err := asaEncoder.finish()
+			if err != nil {
+				t.Fatalf("finish: %s", err)
+			}
+
+			if wire.String() != test.wire {
+				t.Errorf("wire = %q, want %q", wire.String(), test.wire)
+			}
+
+			decoded, err := io.ReadAll(newASADecoder(strings.NewReader(test.wire)))
+			if err != nil {
+				t.Fatalf("decoding: %s", err)
+			}
+			if string(decoded) != test.decoded {
+				t.Errorf("decoded = %q, want %q", decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestASADecoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		wire    string
+		decoded string
+	}{
+		{name: "overprint on first line is ignored", wire: "+a\n", decoded: "a\n"},
+		{name: "unknown control is single space", wire: " a\nxb\n", decoded: "a\nb\n"},
+		{name: "last line without line ending", wire: " a\n b", decoded: "a\nb\n"},
+		{name: "new page in the middle", wire: " a\n1b\n", decoded: "a\n\fb\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := io.ReadAll(newASADecoder(strings.NewReader(test.wire)))
+			if err != nil {
+				t.Fatalf("decoding: %s", err)
+			}
+			if string(decoded) != test.decoded {
+				t.Errorf("decoded = %q, want %q", decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestASADecoderSmallReads(t *testing.T) {
+	// advance of triple space does not fit into one byte reads
+	decoder := newASADecoder(strings.NewReader(" a\n-b\n"))
+
+	var decoded []byte
+	buffer := make([]byte, 1)
+	for {
+		n, err := decoder.Read(buffer)
+		decoded = append(decoded, buffer[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("decoding: %s", err)
+		}
+	}
+
+	if string(decoded) != "a\n\n\nb\n" {
+		t.Errorf("decoded = %q", decoded)
+	}
+}
+
+func TestASAWithTransferType(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters TransferParameters
+		wire       []byte
+	}{
+		{
+			name:       "ascii type ends lines with CRLF",
+			parameters: TransferParameters{Type: TYPE_ASCII, Format: FORMAT_ASA, Mode: MODE_STREAM, Structure: STRUCTURE_FILE},
+			wire:       []byte(" a\r\n0b\r\n"),
+		},
+		{
+			name:       "ebcdic type translates control characters",
+			parameters: TransferParameters{Type: TYPE_EBCDIC, Format: FORMAT_ASA, Mode: MODE_STREAM, Structure: STRUCTURE_FILE},
+			wire:       []byte{0x40, 0x81, 0x15, 0xF0, 0x82, 0x15},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wire := encodeChunks(t, test.parameters, "a\n\nb\n")
+			if !bytes.Equal(wire, test.wire) {
+				t.Errorf("wire = %q, want %q", wire, test.wire)
+			}
+
+			decoded, err := decodeWire(t, test.parameters, wire)
+			if err != nil {
+				t.Fatalf("decoding: %s", err)
+			}
+			if string(decoded) != "a\n\nb\n" {
+				t.Errorf("decoded = %q", decoded)
+			}
+		})
+	}
+}
+
+func TestLocalOffsetRefusesFormatEffectors(t *testing.T) {
+	refused := []TransferParameters{
+		{Type: TYPE_ASCII, Format: FORMAT_ASA, Mode: MODE_STREAM, Structure: STRUCTURE_FILE},
+		{Type: TYPE_EBCDIC, Format: FORMAT_ASA, Mode: MODE_STREAM, Structure: STRUCTURE_FILE},
+		{Type: TYPE_ASCII, Format: FORMAT_TELNET, Mode: MODE_STREAM, Structure: STRUCTURE_FILE},
+	}
+
+	for _, parameters := range refused {
+		_, err := parameters.LocalOffset(strings.NewReader("a\nb\n"), 1)
+		if err == nil {
+			t.Errorf("restart accepted for TYPE %s %s", parameters.Type, parameters.Format)
+		}
+	}
+
+	// telnet format of EBCDIC does not change data
+	parameters := TransferParameters{Type: TYPE_EBCDIC, Format: FORMAT_TELNET, Mode: MODE_STREAM, Structure: STRUCTURE_FILE}
+	offset, err := parameters.LocalOffset(strings.NewReader("a\nb\n"), 2)
+	if err != nil || offset != 2 {
+		t.Errorf("EBCDIC telnet offset = %d, %v, want 2", offset, err)
+	}
+}
@@ -0,0 +1,177 @@
+package connection
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ASCII type sends lines ended by CRLF, local files use LF only.
+// LF already preceded by CR is sent unchanged, so files with CRLF line endings are not corrupted.
+
+// ErrOffsetInsideLineEnding is returned when ASCII offset points between CR and LF that were added by translation
+var ErrOffsetInsideLineEnding = errors.New("offset points inside translated line ending")
+
+// asciiEncoder translates local line endings to CRLF
+type asciiEncoder struct {
+	encoder
+	telnetFormat bool // bare CR is sent as CR NUL, so it is not mistaken for line ending (Telnet format effectors)
+	pendingCR    bool // CR was last byte of previous write, next byte decides if it ends line
+}
+
+func newASCIIEncoder(next encoder, telnetFormat bool) *asciiEncoder {
+	return &asciiEncoder{encoder: next, telnetFormat: telnetFormat}
+}
+
+func (ascii *asciiEncoder) Write(data []byte) (int, error) {
+	translated := make([]byte, 0, len(data)+len(data)/16)
+
+	for _, value := range data {
+		if ascii.pendingCR {
+			ascii.pendingCR = false
+			translated = append(translated, '\r')
+
+			if value == '\n' {
+				translated = append(translated, '\n')
+				continue
+			}
+			translated = ascii.appendBareCR(translated)
+		}
+
+		switch value {
+		case '\r':
+			ascii.pendingCR = true
+		case '\n':
+			translated = append(translated, '\r', '\n')
+		default:
+			translated = append(translated, value)
+		}
+	}
+
+	_, err := ascii.encoder.Write(translated)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// appendBareCR completes CR that is not followed by LF
+func (ascii *asciiEncoder) appendBareCR(translated []byte) []byte {
+	if ascii.telnetFormat {
+		return append(translated, 0)
+	}
+
+	return translated
+}
+
+func (ascii *asciiEncoder) finish() error {
+	if ascii.pendingCR {
+		ascii.pendingCR = false
+
+		_, err := ascii.encoder.Write(ascii.appendBareCR([]byte{'\r'}))
+		if err != nil {
+			return err
+		}
+	}
+
+	return ascii.encoder.finish()
+}
+
+// asciiDecoder translates CRLF to local line ending, CR not followed by LF is kept
+type asciiDecoder struct {
+	reader       *bufio.Reader
+	telnetFormat bool // CR NUL is bare CR
+}
+
+func newASCIIDecoder(reader io.Reader, telnetFormat bool) *asciiDecoder {
+	return &asciiDecoder{reader: bufio.NewReaderSize(reader, CHUNK_SIZE), telnetFormat: telnetFormat}
+}
+
+func (ascii *asciiDecoder) Read(data []byte) (int, error) {
+	n := 0
+	for n < len(data) {
+		// only block when nothing was translated yet
+		if n > 0 && ascii.reader.Buffered() == 0 {
+			break
+		}
+
+		value, err := ascii.reader.ReadByte()
+		if err != nil {
+			return n, err
+		}
+
+		if value == '\r' {
+			next, err := ascii.reader.Peek(1)
+			if err == nil && next[0] == '\n' {
+				continue
+			}
+			if err == nil && next[0] == 0 && ascii.telnetFormat {
+				_, _ = ascii.reader.Discard(1)
+			}
+		}
+
+		data[n] = value
+		n++
+	}
+
+	return n, nil
+}
+
+// asciiLocalOffset converts offset in data translated to ASCII type to offset in local data
+func asciiLocalOffset(reader io.Reader, asciiOffset int64) (int64, error) {
+	var localOffset, translatedOffset int64
+	found := false
+
+	err := scanASCII(reader, func(translatedSize int64) bool {
+		if translatedOffset+translatedSize > asciiOffset {
+			found = true
+			return false
+		}
+
+		localOffset++
+		translatedOffset += translatedSize
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if !found && translatedOffset < asciiOffset {
+		return 0, fmt.Errorf("offset %d is after end of file", asciiOffset)
+	}
+
+	// only CR of translated line ending was transferred
+	if translatedOffset < asciiOffset {
+		return 0, ErrOffsetInsideLineEnding
+	}
+
+	return localOffset, nil
+}
+
+// scanASCII calls visit with translated size of every local byte, until visit returns false
+func scanASCII(reader io.Reader, visit func(translatedSize int64) bool) error {
+	bufferedReader := bufio.NewReaderSize(reader, CHUNK_SIZE)
+	previousCR := false
+
+	for {
+		value, err := bufferedReader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading data: %s", err)
+		}
+
+		translatedSize := int64(1)
+		if value == '\n' && !previousCR {
+			translatedSize = 2
+		}
+		previousCR = value == '\r'
+
+		if !visit(translatedSize) {
+			return nil
+		}
+	}
+}
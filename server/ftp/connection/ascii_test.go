@@ -0,0 +1,186 @@
+package connection
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func asciiParameters(format DataFormat) TransferParameters {
+	return TransferParameters{Type: TYPE_ASCII, Format: format, Mode: MODE_STREAM, Structure: STRUCTURE_FILE}
+}
+
+func TestASCIIRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  DataFormat
+		chunks  []string
+		wire    string
+		decoded string
+	}{
+		{
+			name:    "LF is sent as CRLF",
+			format:  FORMAT_NON_PRINT,
+			chunks:  []string{"a\nb\n"},
+			wire:    "a\r\nb\r\n",
+			decoded: "a\nb\n",
+		},
+		{
+			name:    "CRLF is not doubled",
+			format:  FORMAT_NON_PRINT,
+			chunks:  []string{"a\r\nb"},
+			wire:    "a\r\nb",
+			decoded: "a\nb",
+		},
+		{
+			name:    "CRLF split across writes",
+			format:  FORMAT_NON_PRINT,
+			chunks:  []string{"a\r", "\nb"},
+			wire:    "a\r\nb",
+			decoded: "a\nb",
+		},
+		{
+			name:    "bare CR split across writes",
+			format:  FORMAT_NON_PRINT,
+			chunks:  []string{"a\r", "b"},
+			wire:    "a\rb",
+			decoded: "a\rb",
+		},
+		{
+			name:    "bare CR at end of file",
+			format:  FORMAT_NON_PRINT,
+			chunks:  []string{"a\r"},
+			wire:    "a\r",
+			decoded: "a\r",
+		},
+		{
+			name:    "telnet format sends bare CR as CR NUL",
+			format:  FORMAT_TELNET,
+			chunks:  []string{"a\r", "b\n"},
+			wire:    "a\r\x00b\r\n",
+			decoded: "a\rb\n",
+		},
+		{
+			name:    "telnet format bare CR at end of file",
+			format:  FORMAT_TELNET,
+			chunks:  []string{"a\r"},
+			wire:    "a\r\x00",
+			decoded: "a\r",
+		},
+		{
+			name:    "non print format keeps NUL after CR",
+			format:  FORMAT_NON_PRINT,
+			chunks:  []string{"a\r\x00b"},
+			wire:    "a\r\x00b",
+			decoded: "a\r\x00b",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parameters := asciiParameters(test.format)
+
+			wire := encodeChunks(t, parameters, test.chunks...)
+			if string(wire) != test.wire {
+				t.Errorf("wire = %q, want %q", wire, test.wire)
+			}
+
+			decoded, err := decodeWire(t, parameters, wire)
+			if err != nil {
+				t.Fatalf("decoding: %s", err)
+			}
+			if string(decoded) != test.decoded {
+				t.Errorf("decoded = %q, want %q", decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestASCIIDecoderCRLFSplitAcrossReads(t *testing.T) {
+	// decoder reads CR at the end of its buffer and LF from the next one
+	local := strings.Repeat("x", CHUNK_SIZE-1) + "\r\n" + "y"
+
+	decoded, err := decodeWire(t, asciiParameters(FORMAT_NON_PRINT), []byte(local))
+	if err != nil {
+		t.Fatalf("decoding: %s", err)
+	}
+
+	want := strings.Repeat("x", CHUNK_SIZE-1) + "\n" + "y"
+	if string(decoded) != want {
+		t.Errorf("decoded %d bytes, line ending not translated", len(decoded))
+	}
+}
+
+func TestASCIITransferSize(t *testing.T) {
+	tests := []struct {
+		local string
+		size  int64
+	}{
+		{"", 0},
+		{"ab", 2},
+		{"a\nb\n", 6},
+		{"a\r\nb", 4},
+		{"a\rb", 3},
+	}
+
+	for _, test := range tests {
+		size, err := asciiParameters(FORMAT_NON_PRINT).TransferSize(strings.NewReader(test.local))
+		if err != nil {
+			t.Fatalf("TransferSize(%q): %s", test.local, err)
+		}
+		if size != test.size {
+			t.Errorf("TransferSize(%q) = %d, want %d", test.local, size, test.size)
+		}
+	}
+}
+
+func TestASCIILocalOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  string
+		offset int64
+		want   int64
+		err    error
+	}{
+		{name: "start of file", local: "ab\ncd", offset: 0, want: 0},
+		{name: "before line ending", local: "ab\ncd", offset: 2, want: 2},
+		{name: "inside translated line ending", local: "ab\ncd", offset: 3, err: ErrOffsetInsideLineEnding},
+		{name: "after line ending", local: "ab\ncd", offset: 4, want: 3},
+		{name: "end of file", local: "ab\ncd", offset: 6, want: 5},
+		{name: "after end of file", local: "ab\ncd", offset: 7, err: errAnyError},
+		{name: "local CRLF is not translated", local: "a\r\nb", offset: 2, want: 2},
+		{name: "every LF adds one byte", local: "\n\n\nx", offset: 6, want: 3},
+		{name: "between translated line endings", local: "\n\n\nx", offset: 5, err: ErrOffsetInsideLineEnding},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			offset, err := asciiParameters(FORMAT_NON_PRINT).LocalOffset(strings.NewReader(test.local), test.offset)
+
+			switch {
+			case test.err == errAnyError:
+				if err == nil {
+					t.Errorf("offset %d accepted", test.offset)
+				}
+			case test.err != nil:
+				if !errors.Is(err, test.err) {
+					t.Errorf("error = %v, want %v", err, test.err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case offset != test.want:
+				t.Errorf("local offset = %d, want %d", offset, test.want)
+			}
+		})
+	}
+}
+
+func TestLocalOffsetRefusesTelnetFormat(t *testing.T) {
+	_, err := asciiParameters(FORMAT_TELNET).LocalOffset(strings.NewReader("a\rb"), 1)
+	if err == nil {
+		t.Error("restart in telnet format accepted")
+	}
+}
+
+// errAnyError marks test cases where only presence of error is checked
+var errAnyError = errors.New("any error")
@@ -0,0 +1,159 @@
+package connection
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// block header is descriptor byte followed by 16 bit byte count
+const BLOCK_HEADER_SIZE = 3
+const MAX_BLOCK_SIZE = 0xFFFF
+
+// block descriptor flags
+const (
+	BLOCK_EOR            = 128
+	BLOCK_EOF            = 64
+	BLOCK_SUSPECTED_DATA = 32
+	BLOCK_RESTART_MARKER = 16
+)
+
+// blockEncoder splits data into blocks. Last block is held back until more data comes,
+// so end of file flag can be set on it instead of sending empty block.
+type blockEncoder struct {
+	writer     io.Writer
+	records    bool // record separators end blocks with EOR flag
+	descriptor byte
+	data       []byte
+}
+
+func newBlockEncoder(writer io.Writer, records bool) *blockEncoder {
+	return &blockEncoder{writer: writer, records: records, data: make([]byte, 0, MAX_BLOCK_SIZE)}
+}
+
+func (encoder *blockEncoder) Write(data []byte) (int, error) {
+	for _, value := range data {
+		// previous block is complete, more data means it was not the last one
+		if encoder.descriptor&BLOCK_EOR != 0 || len(encoder.data) == MAX_BLOCK_SIZE {
+			err := encoder.writeBlock()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if encoder.records && value == RECORD_SEPARATOR {
+			encoder.descriptor |= BLOCK_EOR
+			continue
+		}
+
+		encoder.data = append(encoder.data, value)
+	}
+
+	return len(data), nil
+}
+
+func (encoder *blockEncoder) finish() error {
+	// last record without separator is still a record
+	if encoder.records && len(encoder.data) > 0 {
+		encoder.descriptor |= BLOCK_EOR
+	}
+
+	encoder.descriptor |= BLOCK_EOF
+	return encoder.writeBlock()
+}
+
+func (encoder *blockEncoder) writeBlock() error {
+	header := [BLOCK_HEADER_SIZE]byte{encoder.descriptor}
+	binary.BigEndian.PutUint16(header[1:], uint16(len(encoder.data)))
+
+	_, err := encoder.writer.Write(header[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = encoder.writer.Write(encoder.data)
+	if err != nil {
+		return err
+	}
+
+	encoder.descriptor = 0
+	encoder.data = encoder.data[:0]
+
+	return nil
+}
+
+// blockDecoder returns data of received blocks, EOR flag is replaced with record separator
+type blockDecoder struct {
+	reader    *bufio.Reader
+	records   bool
+	remaining int  // bytes of current block that were not read yet
+	endOfFile bool // current block is the last one
+	endRecord bool // current block ends record
+}
+
+// ErrMissingEndOfFile is returned when sender closed data connection before sending block with EOF flag
+var ErrMissingEndOfFile = errors.New("data connection closed before end of file block")
+
+func newBlockDecoder(reader *bufio.Reader, records bool) *blockDecoder {
+	return &blockDecoder{reader: reader, records: records}
+}
+
+func (decoder *blockDecoder) Read(data []byte) (int, error) {
+	for decoder.remaining == 0 {
+		if decoder.endRecord {
+			decoder.endRecord = false
+			data[0] = RECORD_SEPARATOR
+			return 1, nil
+		}
+
+		if decoder.endOfFile {
+			return 0, io.EOF
+		}
+
+		err := decoder.readHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := decoder.reader.Read(data[:min(len(data), decoder.remaining)])
+	decoder.remaining -= n
+
+	if errors.Is(err, io.EOF) {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (decoder *blockDecoder) readHeader() error {
+	var header [BLOCK_HEADER_SIZE]byte
+
+	_, err := io.ReadFull(decoder.reader, header[:])
+	if errors.Is(err, io.EOF) {
+		return ErrMissingEndOfFile
+	}
+	if err != nil {
+		return fmt.Errorf("reading block header: %w", err)
+	}
+
+	descriptor := header[0]
+	count := int(binary.BigEndian.Uint16(header[1:]))
+
+	// restart markers are not supported, their data is skipped
+	if descriptor&BLOCK_RESTART_MARKER != 0 {
+		_, err = decoder.reader.Discard(count)
+		if err != nil {
+			return fmt.Errorf("skipping restart marker: %w", err)
+		}
+		count = 0
+	}
+
+	decoder.remaining = count
+	decoder.endOfFile = descriptor&BLOCK_EOF != 0
+	decoder.endRecord = decoder.records && descriptor&BLOCK_EOR != 0
+
+	return nil
+}
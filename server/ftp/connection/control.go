@@ -2,24 +2,30 @@ package connection
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"slices"
+	"sync"
+	"time"
 )
 
-const TELNET_IAC = 255 // interrupt as command
-const TELNET_IP = 244
-const TELNET_DATA_MARK = 242
-
 type ControlConnection struct {
 	rawConnection *net.Conn
 	reader        *bufio.Reader
 	writer        *bufio.Writer
+	telnet        *telnetParser // keeps part of line received before read deadline expired
+	writeLock     *sync.Mutex   // replies of background transfers can be sent concurrently with control loop
+	writeTimeout  time.Duration // client that does not read replies for this long is disconnected, 0 disables it
 }
 
-func NewConnection(rawConnection *net.Conn) *ControlConnection {
+// ErrLineTooLong is returned by ReceiveLine when command line exceeds maximum length, the line is discarded
+var ErrLineTooLong = errors.New("command line too long")
+
+func NewConnection(rawConnection *net.Conn, maxLineLength int, writeTimeout time.Duration) *ControlConnection {
 	reader := bufio.NewReader(*rawConnection)
 	writer := bufio.NewWriter(*rawConnection)
 
@@ -27,70 +33,179 @@ func NewConnection(rawConnection *net.Conn) *ControlConnection {
 		rawConnection: rawConnection,
 		reader:        reader,
 		writer:        writer,
+		telnet:        newTelnetParser(maxLineLength),
+		writeLock:     &sync.Mutex{},
+		writeTimeout:  writeTimeout,
 	}
 
+	enableInlineUrgentData(rawConnection)
+
 	return conn
 }
 
+// ReceiveLine reads one command line, Telnet commands are removed from it and option negotiation is answered.
+// When read deadline expires, already received part of line is kept
+// and the returned error wraps os.ErrDeadlineExceeded, so reading can continue with new deadline.
 func (conn *ControlConnection) ReceiveLine() (string, error) {
+	for {
+		data, err := conn.reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return "", fmt.Errorf("ControlConnection closed (EOF)")
+			}
+			return "", fmt.Errorf("reading line from ControlConnection: %w", err)
+		}
 
-	line, _, err := conn.reader.ReadLine()
+		lineComplete, reply := conn.telnet.feed(data)
 
-	if err != nil {
+		if reply != nil {
+			err = conn.sendTelnet(reply)
+			if err != nil {
+				return "", err
+			}
+		}
 
-		if err == io.EOF {
-			return "", fmt.Errorf("ControlConnection closed (EOF)")
+		if !lineComplete {
+			continue
 		}
-		return "", fmt.Errorf("reading line from ControlConnection: %s", err)
 
-	}
+		line, tooLong := conn.telnet.takeLine()
+		if tooLong {
+			return "", ErrLineTooLong
+		}
 
-	//log.Printf("ReceiveLine: %s", line)
+		//log.Printf("ReceiveLine: %s", line)
 
-	return dataToCommand(line), nil
+		return line, nil
+	}
 }
 
-var bytesToSkip = []byte{TELNET_IAC, TELNET_IP, TELNET_DATA_MARK}
-
-func dataToCommand(data []byte) string {
-	dataStartIdx := 0
+// sendTelnet sends raw Telnet command, data bytes 255 in it are not escaped
+func (conn *ControlConnection) sendTelnet(command []byte) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
 
-	// it is just raw data
-	if len(data) >= 2 && data[0] == TELNET_IAC {
-
-		// TELNET Command has to be at least 2 bytes long
-		dataStartIdx = 2
+	return conn.write(command)
+}
 
-		// skip all control bytes
-		// maybe only skip if first byte is IAC?
-		if dataStartIdx < len(bytesToSkip) && slices.Contains(bytesToSkip, data[dataStartIdx]) {
-			dataStartIdx++
+// write sends data within write timeout. Connection is closed when it fails, so the reading side ends too,
+// client that stopped reading replies would otherwise block every later write.
+func (conn *ControlConnection) write(data []byte) error {
+	if conn.writeTimeout > 0 {
+		err := (*conn.rawConnection).SetWriteDeadline(time.Now().Add(conn.writeTimeout))
+		if err != nil {
+			return fmt.Errorf("setting write deadline on ControlConnection: %s", err)
 		}
+	}
 
-		log.Printf("command line has telnet control sequence, skipping %d bytes", dataStartIdx)
+	_, err := conn.writer.Write(data)
+	if err == nil {
+		err = conn.writer.Flush()
 	}
+	if err != nil {
+		_ = (*conn.rawConnection).Close()
+		return fmt.Errorf("writing to ControlConnection: %w", err)
+	}
+
+	return nil
+}
 
-	return string(data[dataStartIdx:])
+// SetReadDeadline limits how long ReceiveLine waits for the client
+func (conn *ControlConnection) SetReadDeadline(deadline time.Time) error {
+	return (*conn.rawConnection).SetReadDeadline(deadline)
 }
 
+// SendString sends reply, byte 255 (Telnet IAC) in it is doubled, so it reaches the client as data
 func (conn *ControlConnection) SendString(msg string) error {
-	_, err := conn.writer.WriteString(msg)
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
 
-	if err != nil {
-		return fmt.Errorf("writing line to ControlConnection: %s", err)
+	return conn.write([]byte(escapeIAC(msg)))
+}
+
+// Handshake runs TLS handshake on protected connection, plain connection is left untouched.
+// Client that does not finish the handshake within timeout is refused.
+func (conn *ControlConnection) Handshake(timeout time.Duration) error {
+	tlsConnection, ok := (*conn.rawConnection).(*tls.Conn)
+	if !ok {
+		return nil
 	}
 
-	// this can be optimized
-	err = conn.writer.Flush()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := tlsConnection.HandshakeContext(ctx)
 	if err != nil {
-		return fmt.Errorf("flushing data to ControlConnection: %s", err)
+		return fmt.Errorf("TLS handshake: %s", err)
 	}
 
-	//log.Printf("%d byres written: %s", n, msg)
+	log.Printf("TLS handshake finished, version %s", tls.VersionName(tlsConnection.ConnectionState().Version))
+	return nil
+}
 
+// StartTLS protects plain connection by TLS after AUTH TLS was answered, handshake has to finish within timeout.
+// Commands the client sent before the handshake are refused, they could have been injected into the plain connection.
+func (conn *ControlConnection) StartTLS(config *tls.Config, timeout time.Duration) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	if conn.reader.Buffered() > 0 {
+		return fmt.Errorf("%d bytes received after AUTH TLS before TLS handshake", conn.reader.Buffered())
+	}
+
+	var tlsConnection net.Conn = tls.Server(*conn.rawConnection, config)
+	conn.rawConnection = &tlsConnection
+	conn.reader = bufio.NewReader(tlsConnection)
+	conn.writer = bufio.NewWriter(tlsConnection)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := tlsConnection.(*tls.Conn).HandshakeContext(ctx)
+	if err != nil {
+		return fmt.Errorf("TLS handshake: %s", err)
+	}
+
+	log.Printf("control connection upgraded to TLS, version %s", tls.VersionName(tlsConnection.(*tls.Conn).ConnectionState().Version))
 	return nil
 }
 
+// IsTLS reports whether ControlConnection is protected by TLS
+func (conn *ControlConnection) IsTLS() bool {
+	_, ok := (*conn.rawConnection).(*tls.Conn)
+	return ok
+}
+
+// RemoteIP returns address of the client, nil if it is not TCP connection
+func (conn *ControlConnection) RemoteIP() net.IP {
+	remoteAddress, ok := (*conn.rawConnection).RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+
+	return remoteAddress.IP
+}
+
+// LocalIP returns address of the server on this connection, nil if it is not TCP connection
+func (conn *ControlConnection) LocalIP() net.IP {
+	localAddress, ok := (*conn.rawConnection).LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+
+	return localAddress.IP
+}
+
+// TLSState returns state of TLS connection, false if connection is not protected
+func (conn *ControlConnection) TLSState() (tls.ConnectionState, bool) {
+	tlsConnection, ok := (*conn.rawConnection).(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+
+	return tlsConnection.ConnectionState(), true
+}
+
 func (conn *ControlConnection) Close() error {
 	if conn == nil {
 		log.Printf("Tried to close connection that was nul")
@@ -0,0 +1,59 @@
+package connection
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSendStringTimesOutWhenClientDoesNotRead(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conn := NewConnection(&server, 512, 50*time.Millisecond)
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- conn.SendString("200 Command okay.\r\n")
+	}()
+
+	select {
+	case err := <-sent:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("error = %v, want deadline exceeded", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("SendString blocked on client that does not read")
+	}
+
+	// connection is closed, so reading of commands ends as well
+	_, err := conn.ReceiveLine()
+	if err == nil {
+		t.Error("ReceiveLine succeeded on connection closed by failed write")
+	}
+}
+
+func TestStartTLSRefusesCommandsSentBeforeHandshake(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conn := NewConnection(&server, 512, time.Second)
+
+	// command pipelined after AUTH TLS would be taken as sent over protected connection
+	go func() {
+		_, _ = client.Write([]byte("AUTH TLS\r\nUSER anonymous\r\n"))
+	}()
+
+	line, err := conn.ReceiveLine()
+	if err != nil || line != "AUTH TLS" {
+		t.Fatalf("ReceiveLine = %q, %v", line, err)
+	}
+
+	err = conn.StartTLS(&tls.Config{}, time.Second)
+	if err == nil {
+		t.Error("TLS started with plain text command waiting")
+	}
+}
@@ -2,6 +2,8 @@ package connection
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +11,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -31,7 +34,10 @@ const (
 	MODE_COMPRESSED TransmissionMode = "C"
 )
 
-const CHUNK_SIZE = 1024
+const CHUNK_SIZE = 32 * 1024
+
+// ErrDataConnectionTimeout is returned when client did not connect to the data port in time
+var ErrDataConnectionTimeout = errors.New("timeout waiting for data connection")
 
 type DataType string
 type DataFormat string
@@ -39,16 +45,41 @@ type TransmissionMode string
 
 type DataConnection struct {
 	connection           *net.Conn
+	transfer             *transferConn // connection used by running transfer, it can be interrupted
 	reader               *bufio.Reader
 	writer               *bufio.Writer
 	isReady              bool
 	newConnectionChannel chan *net.Conn
 	address              net.TCPAddr
+	activeAddress        *net.TCPAddr // set in active mode, server connects to the client when transfer starts
+	settings             DataConnectionSettings
+	listener             net.Listener  // passive mode listener, nil in active mode
+	released             chan struct{} // closed when data connection is no longer used by session
+	releaseOnce          *sync.Once
+}
+
+// DataConnectionSettings configures how data connection is established with the client
+type DataConnectionSettings struct {
+	// TLSConfig protects accepted connections, nil means plain data connection
+	TLSConfig *tls.Config
+	// RequireTLSSessionReuse rejects connections that did not resume TLS session of control connection
+	RequireTLSSessionReuse bool
+	// HandshakeTimeout limits TLS handshake on protected connection
+	HandshakeTimeout time.Duration
+	// ClientIP is address of control connection peer, passive connections from other addresses are rejected.
+	// nil disables the check
+	ClientIP net.IP
+	// ConnectTimeout limits how long we wait for client to connect (or for connecting to the client in active mode)
+	ConnectTimeout time.Duration
+	// IdleTimeout aborts transfer when no data is read or written for this long, 0 disables it
+	IdleTimeout time.Duration
+	// ListenerLifetime closes passive listener after this time even if the client never connected, 0 disables it
+	ListenerLifetime time.Duration
 }
 
 // OpenPassiveDataConnection starts listening for ControlConnection
 // when ControlConnection is ready, send ControlConnection in channel
-func OpenPassiveDataConnection() (*DataConnection, error) {
+func OpenPassiveDataConnection(settings DataConnectionSettings) (*DataConnection, error) {
 	listener, err := net.Listen("tcp", ":")
 	if err != nil {
 		return nil, fmt.Errorf("starting listener for passive data ControlConnection: %s", err)
@@ -56,22 +87,52 @@ func OpenPassiveDataConnection() (*DataConnection, error) {
 
 	log.Printf("data ControlConnection listener started")
 	connectionChan := make(chan *net.Conn)
+	released := make(chan struct{})
 
 	address := *listener.Addr().(*net.TCPAddr)
 
+	// unused listener would otherwise stay open until session ends
+	if settings.ListenerLifetime > 0 {
+		time.AfterFunc(settings.ListenerLifetime, func() {
+			err := listener.Close()
+			if err == nil {
+				log.Printf("passive listener on port %d expired", address.Port)
+			}
+		})
+	}
+
 	// in another thread listen to new ControlConnection
 	// in case there is error in ControlConnection we can just abort current command and new ControlConnection will be used for another command
 	go func() {
+		// waiting session finds out that no connection will come
+		defer close(connectionChan)
+
 		for {
 			conn, err := listener.Accept()
-
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				log.Printf("Error accepting data ControlConnection: %s ", err)
+				continue
 			}
 
 			log.Printf("New dtc accepted")
 
-			connectionChan <- &conn
+			// rejected connection is closed and we keep waiting for the legitimate client
+			conn, err = settings.verifyPassiveConnection(conn)
+			if err != nil {
+				log.Printf("Rejected data connection from %s: %s", conn.RemoteAddr(), err)
+				_ = conn.Close()
+				continue
+			}
+
+			select {
+			case connectionChan <- &conn:
+			case <-released:
+				_ = conn.Close()
+				return
+			}
 		}
 	}()
 
@@ -80,23 +141,146 @@ func OpenPassiveDataConnection() (*DataConnection, error) {
 		isReady:              false,
 		address:              address,
 		newConnectionChannel: connectionChan,
+		settings:             settings,
+		listener:             listener,
+		released:             released,
+		releaseOnce:          &sync.Once{},
 	}, nil
 }
 
-func (dataConnection *DataConnection) FormatAddressForPASV() (string, error) {
+// OpenActiveDataConnection prepares data connection that server opens to address when transfer starts.
+// Address has to be validated by caller, to prevent bounce attacks.
+func OpenActiveDataConnection(address *net.TCPAddr, settings DataConnectionSettings) *DataConnection {
+	return &DataConnection{
+		connection:    nil,
+		isReady:       false,
+		activeAddress: address,
+		settings:      settings,
+		released:      make(chan struct{}),
+		releaseOnce:   &sync.Once{},
+	}
+}
 
-	ipPart, portPart, _ := strings.Cut(dataConnection.address.String(), ":")
+// verifyPassiveConnection checks that connection accepted on passive port comes from the client
+func (settings DataConnectionSettings) verifyPassiveConnection(conn net.Conn) (net.Conn, error) {
+	// anyone scanning ports could otherwise steal download or inject upload
+	if settings.ClientIP != nil {
+		remoteAddress, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !remoteAddress.IP.Equal(settings.ClientIP) {
+			return conn, fmt.Errorf("remote address does not match control connection peer %s", settings.ClientIP)
+		}
+	}
+
+	return settings.verifyConnection(conn)
+}
 
-	parts := make([]string, 0)
-	parts = append(parts, strings.Split(ipPart, ".")...)
+// verifyConnection wraps data connection in TLS and checks that it can be handed to the session
+func (settings DataConnectionSettings) verifyConnection(conn net.Conn) (net.Conn, error) {
+	if settings.TLSConfig == nil {
+		return conn, nil
+	}
+
+	tlsConnection := tls.Server(conn, settings.TLSConfig)
+
+	// handshake is finished here, so the session resumption can be checked before any data is transferred
+	_ = tlsConnection.SetDeadline(time.Now().Add(settings.HandshakeTimeout))
+	err := tlsConnection.Handshake()
+	if err != nil {
+		return conn, fmt.Errorf("TLS handshake on data connection: %s", err)
+	}
+	_ = tlsConnection.SetDeadline(time.Time{})
+
+	if settings.RequireTLSSessionReuse && !tlsConnection.ConnectionState().DidResume {
+		return tlsConnection, fmt.Errorf("TLS session of control connection was not reused")
+	}
+
+	return tlsConnection, nil
+}
+
+// FormatAddressForPASV formats IPv4 address of the server and listener port as h1,h2,h3,h4,p1,p2.
+// Listener accepts on all interfaces, so the address is taken from control connection.
+func (dataConnection *DataConnection) FormatAddressForPASV(ip net.IP) string {
+	parts := make([]string, 0, 6)
+	for _, value := range ip.To4() {
+		parts = append(parts, strconv.Itoa(int(value)))
+	}
 
-	port, _ := strconv.Atoi(portPart)
+	port := dataConnection.Port()
 	// port = p1*256+p2
 	parts = append(parts, strconv.Itoa(port/256))
 	parts = append(parts, strconv.Itoa(port%256))
 
-	formatted := fmt.Sprintf("(%s)", strings.Join(parts, ","))
-	return formatted, nil
+	return strings.Join(parts, ",")
+}
+
+// ParsePORTAddress parses h1,h2,h3,h4,p1,p2 argument of PORT command
+func ParsePORTAddress(argument string) (*net.TCPAddr, error) {
+	parts := strings.Split(argument, ",")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("expected 6 comma separated numbers, got %d", len(parts))
+	}
+
+	numbers := make([]byte, len(parts))
+	for idx, part := range parts {
+		number, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s: %s", part, err)
+		}
+		numbers[idx] = byte(number)
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IPv4(numbers[0], numbers[1], numbers[2], numbers[3]),
+		Port: int(numbers[4])*256 + int(numbers[5]),
+	}, nil
+}
+
+// ErrUnsupportedNetworkProtocol is returned by ParseEPRTAddress for protocols other than 1 (IPv4) and 2 (IPv6)
+var ErrUnsupportedNetworkProtocol = errors.New("unsupported network protocol")
+
+// ParseEPRTAddress parses |protocol|address|port| argument of EPRT command (RFC 2428)
+func ParseEPRTAddress(argument string) (*net.TCPAddr, error) {
+	if len(argument) < 2 {
+		return nil, fmt.Errorf("argument too short")
+	}
+
+	// first character is delimiter chosen by client
+	delimiter := argument[:1]
+	parts := strings.Split(argument, delimiter)
+	if len(parts) != 5 || parts[0] != "" || parts[4] != "" {
+		return nil, fmt.Errorf("expected <d>protocol<d>address<d>port<d>")
+	}
+
+	protocol, host, portPart := parts[1], parts[2], parts[3]
+	if protocol != "1" && protocol != "2" {
+		return nil, ErrUnsupportedNetworkProtocol
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || (protocol == "1") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid address %s for protocol %s", host, protocol)
+	}
+
+	port, err := strconv.ParseUint(portPart, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port %s", portPart)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Status describes state of data connection for STAT
+func (dataConnection *DataConnection) Status() string {
+	switch {
+	case dataConnection == nil:
+		return "No data connection"
+	case dataConnection.isReady:
+		return "Data connection open"
+	case dataConnection.activeAddress != nil:
+		return fmt.Sprintf("Active mode, connecting to %s", dataConnection.activeAddress)
+	default:
+		return fmt.Sprintf("Passive mode, listening on port %d", dataConnection.Port())
+	}
 }
 
 func (dataConnection *DataConnection) Port() int {
@@ -117,6 +301,7 @@ func (dataConnection *DataConnection) Close() error {
 	dataConnection.reader = nil
 	dataConnection.writer = nil
 	dataConnection.connection = nil
+	dataConnection.transfer = nil
 
 	if err != nil {
 		return err
@@ -125,16 +310,47 @@ func (dataConnection *DataConnection) Close() error {
 	return nil
 }
 
-func (dataConnection *DataConnection) WaitForDataConnection() error {
+// Release closes passive listener together with open connection,
+// it is called when session switches to another data connection or ends
+func (dataConnection *DataConnection) Release() error {
 	if dataConnection == nil {
-		return fmt.Errorf("no data connection listener started, you need to first send EPSV or PASV")
+		return nil
+	}
+
+	dataConnection.releaseOnce.Do(func() {
+		close(dataConnection.released)
+
+		if dataConnection.listener != nil {
+			_ = dataConnection.listener.Close()
+		}
+	})
+
+	return dataConnection.Close()
+}
+
+// WaitForDataConnection opens the data connection, canceling ctx stops waiting for the client
+func (dataConnection *DataConnection) WaitForDataConnection(ctx context.Context) error {
+	if dataConnection == nil {
+		return fmt.Errorf("no data connection listener started, you need to first send EPSV, PASV, PORT or EPRT")
 	}
 
 	if !dataConnection.isReady {
-		// there should be timeout
-		log.Printf("waiting for data connection")
-		// wait until client connects to data ControlConnection
-		dataConnection.connection = <-dataConnection.newConnectionChannel
+		if dataConnection.activeAddress != nil {
+			err := dataConnection.connectActive(ctx)
+			if err != nil {
+				return err
+			}
+		} else {
+			err := dataConnection.acceptPassive(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		// stalled transfer is detected by deadline on every read and write
+		dataConnection.transfer = newTransferConn(*dataConnection.connection, dataConnection.settings.IdleTimeout)
+		var transferConnection net.Conn = dataConnection.transfer
+		dataConnection.connection = &transferConnection
 
 		// using buffered reader and writer for performance
 		dataConnection.reader = bufio.NewReader(*dataConnection.connection)
@@ -145,78 +361,157 @@ func (dataConnection *DataConnection) WaitForDataConnection() error {
 	return nil
 }
 
-func (dataConnection *DataConnection) Send(mode TransmissionMode, dataReader io.Reader, cancelChannel chan bool) error {
+// acceptPassive waits until client connects to passive port
+func (dataConnection *DataConnection) acceptPassive(ctx context.Context) error {
+	log.Printf("waiting for data connection")
+
+	var timeout <-chan time.Time
+	if dataConnection.settings.ConnectTimeout > 0 {
+		timer := time.NewTimer(dataConnection.settings.ConnectTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case conn, ok := <-dataConnection.newConnectionChannel:
+		if !ok {
+			return fmt.Errorf("passive listener is closed, send PASV or EPSV again")
+		}
+		dataConnection.connection = conn
+	case <-timeout:
+		return ErrDataConnectionTimeout
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for data connection: %w", ctx.Err())
+	}
+
+	return nil
+}
+
+// connectActive opens data connection to address client specified in PORT or EPRT
+func (dataConnection *DataConnection) connectActive(ctx context.Context) error {
+	log.Printf("connecting to client data port %s", dataConnection.activeAddress)
+
+	dialer := net.Dialer{Timeout: dataConnection.settings.ConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", dataConnection.activeAddress.String())
+	if err != nil {
+		return fmt.Errorf("connecting to client data port: %w", err)
+	}
+
+	// in FTPS server is TLS server even if it opened the TCP connection
+	conn, err = dataConnection.settings.verifyConnection(conn)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("active data connection rejected: %s", err)
+	}
+
+	dataConnection.connection = &conn
+	return nil
+}
+
+// interruptOnCancel unblocks transfer in progress when ctx is canceled, returned function stops watching ctx
+func (dataConnection *DataConnection) interruptOnCancel(ctx context.Context) func() bool {
+	transfer := dataConnection.transfer
+	return context.AfterFunc(ctx, func() {
+		log.Printf("cancelation requested, interrupting transfer")
+		transfer.interrupt()
+	})
+}
+
+// Send transfers data to the client, canceling ctx aborts the transfer immediately
+func (dataConnection *DataConnection) Send(ctx context.Context, parameters TransferParameters, dataReader io.Reader) error {
 	// ensure that data connection exists and is ready
-	err := dataConnection.WaitForDataConnection()
+	err := dataConnection.WaitForDataConnection(ctx)
 	if err != nil {
-		return fmt.Errorf("waiting for data connection: %s", err)
+		return fmt.Errorf("waiting for data connection: %w", err)
 	}
 
-	// TODO think about cancelation
-	switch mode {
-	case MODE_STREAM:
-		return dataConnection.sendStreamData(dataReader, cancelChannel)
+	stop := dataConnection.interruptOnCancel(ctx)
+	defer stop()
+
+	dataEncoder, err := newEncoder(parameters, dataConnection.writer)
+	if err == nil {
+		err = dataConnection.sendData(ctx, dataReader, dataEncoder)
 	}
 
-	return fmt.Errorf("unsupported mode")
+	// connection is in unknown state after failed transfer (timeout, abort), next transfer needs new one
+	if err != nil {
+		_ = dataConnection.Close()
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("transfer aborted: %w", ctx.Err())
+	}
+
+	return err
 }
 
-func (dataConnection *DataConnection) Receive(mode TransmissionMode, dataWriter io.Writer) error {
+// Receive transfers data from the client, canceling ctx aborts the transfer immediately
+func (dataConnection *DataConnection) Receive(ctx context.Context, parameters TransferParameters, dataWriter io.Writer) error {
 	log.Printf("waiting for data connection to receive data from client")
 
 	// ensure that data connection exists and is ready
-	err := dataConnection.WaitForDataConnection()
+	err := dataConnection.WaitForDataConnection(ctx)
 	if err != nil {
-		return fmt.Errorf("waiting for data connection: %s", err)
+		return fmt.Errorf("waiting for data connection: %w", err)
 	}
 
-	switch mode {
-	case MODE_STREAM:
+	stop := dataConnection.interruptOnCancel(ctx)
+	defer stop()
 
-		log.Printf("start receiving data form client in stream mode")
-		// TODO handle timeout
+	dataDecoder, err := newDecoder(parameters, dataConnection.reader)
+	if err == nil {
+		log.Printf("start receiving data form client, mode %s, structure %s", parameters.Mode, parameters.Structure)
 		// TODO handle file size limit
-		_, err := dataConnection.reader.WriteTo(dataWriter)
-
+		_, err = io.Copy(dataWriter, dataDecoder)
 		if err != nil {
-			return fmt.Errorf("copying data from socket to file: %s", err)
+			err = fmt.Errorf("copying data from socket to file: %w", err)
 		}
+	}
 
-		err = dataConnection.Close()
-		if err != nil {
-			return fmt.Errorf("closing DTC after finished transfer: %s", err)
-		}
+	closeErr := dataConnection.Close()
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("transfer aborted: %w", ctx.Err())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return fmt.Errorf("closing DTC after finished transfer: %s", closeErr)
 	}
 
 	return nil
 }
 
-func (dataConnection *DataConnection) sendStreamData(dataReader io.Reader, cancel chan bool) error {
+// sendData writes data through encoder of transfer mode and structure, then closes the connection
+func (dataConnection *DataConnection) sendData(ctx context.Context, dataReader io.Reader, dataEncoder encoder) error {
 
 	log.Printf("start sending dataReader")
 	chunk := 0
 
-	// send dataReader in chunks
+	// send dataReader in chunks, blocked write is interrupted by interruptOnCancel
 	for {
-		select {
-		case <-cancel:
-			// maybe better way is to just abort the connection
+		if ctx.Err() != nil {
 			return fmt.Errorf("cancelation requested")
-		default:
 		}
 
-		// TODO use read directly to prevent blocking
-		// this works ok, if transmission is slow, if its blocked, abort will not be detected
-		// maybe just set write deadline of connection async, that way we can also just use copy
-		// when we capture we then check if cancel request was send and if so we assume it is the reason for error?
-		writtenSize, err := io.CopyN(dataConnection.writer, dataReader, CHUNK_SIZE)
+		writtenSize, err := io.CopyN(dataEncoder, dataReader, CHUNK_SIZE)
 		chunk += 1
 
 		//log.Printf("Written chunk %d size: %d",
 		//	chunk, writtenSize)
 
-		// TODO remove
-		time.Sleep(10 * time.Millisecond)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("copy dataReader from filereader to socker: %s", err)
+		}
+
+		// TLS connection does not implement ReaderFrom, so data stays in buffer until flushed
+		flushErr := dataConnection.writer.Flush()
+		if flushErr != nil {
+			return fmt.Errorf("flushing DTC after copy: %s", flushErr)
+		}
 
 		// finished sending dataReader
 		if errors.Is(err, io.EOF) || writtenSize < CHUNK_SIZE {
@@ -224,21 +519,20 @@ func (dataConnection *DataConnection) sendStreamData(dataReader io.Reader, cance
 			break
 		}
 
-		if err != nil {
-			return fmt.Errorf("copy dataReader from filereader to socker: %s", err)
-		}
+	}
 
+	err := dataEncoder.finish()
+	if err == nil {
 		err = dataConnection.writer.Flush()
-
-		if err != nil {
-			return fmt.Errorf("flushing DTC after copy: %s", err)
-		}
-
+	}
+	if err != nil {
+		return fmt.Errorf("marking end of file: %s", err)
 	}
 
 	log.Printf("finished sending dataReader")
 
-	err := dataConnection.Close()
+	// block mode could keep the connection open, but closing it works for all modes
+	err = dataConnection.Close()
 
 	if err != nil {
 		return fmt.Errorf("closing DTC after finished transfer: %s", err)
@@ -0,0 +1,106 @@
+package connection
+
+import (
+	"fmt"
+	"io"
+)
+
+// newDataEncoder adds translation of TYPE and its format on top of mode encoder
+func newDataEncoder(parameters TransferParameters, modeEncoder encoder) encoder {
+	dataEncoder := modeEncoder
+
+	switch {
+	case parameters.Type == TYPE_EBCDIC:
+		dataEncoder = newEBCDICEncoder(dataEncoder, parameters.codepage(), parameters.Structure == STRUCTURE_RECORD)
+	case parameters.TranslatesLineEndings():
+		dataEncoder = newASCIIEncoder(dataEncoder, parameters.Format == FORMAT_TELNET)
+	}
+
+	// carriage control is written as local text, which is then translated by TYPE
+	if parameters.usesASA() {
+		dataEncoder = newASAEncoder(dataEncoder)
+	}
+
+	return dataEncoder
+}
+
+// newDataDecoder adds translation of TYPE and its format on top of mode decoder
+func newDataDecoder(parameters TransferParameters, modeDecoder io.Reader) io.Reader {
+	dataDecoder := modeDecoder
+
+	switch {
+	case parameters.Type == TYPE_EBCDIC:
+		dataDecoder = newEBCDICDecoder(dataDecoder, parameters.codepage(), parameters.Structure == STRUCTURE_RECORD)
+	case parameters.TranslatesLineEndings():
+		dataDecoder = newASCIIDecoder(dataDecoder, parameters.Format == FORMAT_TELNET)
+	}
+
+	if parameters.usesASA() {
+		dataDecoder = newASADecoder(dataDecoder)
+	}
+
+	return dataDecoder
+}
+
+// TranslatesLineEndings reports if local line endings are sent as CRLF,
+// records have no line endings, their boundaries are marked by the mode
+func (parameters TransferParameters) TranslatesLineEndings() bool {
+	return parameters.Type == TYPE_ASCII && parameters.Structure == STRUCTURE_FILE
+}
+
+// TranslatesData reports if TYPE changes data, so transferred size differs from local size
+func (parameters TransferParameters) TranslatesData() bool {
+	return parameters.Type == TYPE_EBCDIC || parameters.TranslatesLineEndings() || parameters.usesASA()
+}
+
+func (parameters TransferParameters) usesASA() bool {
+	return (parameters.Type == TYPE_ASCII || parameters.Type == TYPE_EBCDIC) && parameters.Format == FORMAT_ASA
+}
+
+// TransferSize returns size of local data after translation by TYPE, data are translated to find it out
+func (parameters TransferParameters) TransferSize(reader io.Reader) (int64, error) {
+	counter := &byteCounter{}
+	dataEncoder := newDataEncoder(parameters, &streamFileEncoder{Writer: counter})
+
+	_, err := io.Copy(dataEncoder, reader)
+	if err == nil {
+		err = dataEncoder.finish()
+	}
+
+	return counter.count, err
+}
+
+// LocalOffset converts offset in transferred data to offset in local data
+func (parameters TransferParameters) LocalOffset(reader io.Reader, offset int64) (int64, error) {
+	// format effectors change data depending on following bytes, offset inside them can not be restarted
+	if parameters.usesASA() || parameters.TranslatesLineEndings() && parameters.Format == FORMAT_TELNET {
+		return 0, fmt.Errorf("restart is not supported with format %s", parameters.Format)
+	}
+
+	switch {
+	case parameters.Type == TYPE_EBCDIC:
+		return ebcdicLocalOffset(reader, offset)
+	case parameters.TranslatesLineEndings():
+		return asciiLocalOffset(reader, offset)
+	default:
+		return offset, nil
+	}
+}
+
+func (parameters TransferParameters) codepage() *Codepage {
+	if parameters.Codepage == nil {
+		return codepages[DEFAULT_CODEPAGE]
+	}
+
+	return parameters.Codepage
+}
+
+// byteCounter discards written data, only their size is kept
+type byteCounter struct {
+	count int64
+}
+
+func (counter *byteCounter) Write(data []byte) (int, error) {
+	counter.count += int64(len(data))
+	return len(data), nil
+}
@@ -0,0 +1,227 @@
+package connection
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"unicode/utf8"
+)
+
+// EBCDIC type translates local UTF-8 text to single byte EBCDIC code page and back.
+// Characters missing in the code page are sent as EBCDIC SUB.
+
+const DEFAULT_CODEPAGE = "037"
+
+const EBCDIC_SUB = 0x3F
+
+// EBCDIC byte that carries record separator in record structure, so mode can mark record boundaries
+const EBCDIC_RECORD_SEPARATOR = RECORD_SEPARATOR
+
+type Codepage struct {
+	Name        string
+	toUnicode   [256]rune
+	fromUnicode map[rune]byte
+}
+
+var codepages = map[string]*Codepage{
+	"037":  newCodepage("037", CODEPAGE_037_TABLE),
+	"500":  newCodepage("500", CODEPAGE_500_TABLE),
+	"1047": newCodepage("1047", CODEPAGE_1047_TABLE),
+}
+
+func newCodepage(name string, table [256]rune) *Codepage {
+	codepage := &Codepage{Name: name, toUnicode: table, fromUnicode: make(map[rune]byte, len(table))}
+
+	for value, char := range table {
+		codepage.fromUnicode[char] = byte(value)
+	}
+
+	return codepage
+}
+
+// LookupCodepage returns EBCDIC code page by its IBM number
+func LookupCodepage(name string) (*Codepage, bool) {
+	codepage, ok := codepages[name]
+	return codepage, ok
+}
+
+// CodepageNames returns names of supported code pages, sorted by number
+func CodepageNames() []string {
+	names := make([]string, 0, len(codepages))
+	for name := range codepages {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if len(a) != len(b) {
+			return cmp.Compare(len(a), len(b))
+		}
+		return cmp.Compare(a, b)
+	})
+
+	return names
+}
+
+// encode returns EBCDIC byte of character, records keep record separator untranslated
+func (codepage *Codepage) encode(char rune, records bool) byte {
+	if records && char == RECORD_SEPARATOR {
+		return EBCDIC_RECORD_SEPARATOR
+	}
+
+	value, ok := codepage.fromUnicode[char]
+	// character that would be taken as record separator is replaced too
+	if !ok || records && value == EBCDIC_RECORD_SEPARATOR {
+		return EBCDIC_SUB
+	}
+
+	return value
+}
+
+// decode returns character of EBCDIC byte
+func (codepage *Codepage) decode(value byte, records bool) rune {
+	if records && value == EBCDIC_RECORD_SEPARATOR {
+		return RECORD_SEPARATOR
+	}
+
+	return codepage.toUnicode[value]
+}
+
+// ebcdicEncoder translates local UTF-8 text to EBCDIC, bytes that are not valid UTF-8 are taken as Latin-1
+type ebcdicEncoder struct {
+	encoder
+	codepage *Codepage
+	records  bool
+	pending  []byte // start of UTF-8 sequence split between writes
+}
+
+func newEBCDICEncoder(next encoder, codepage *Codepage, records bool) *ebcdicEncoder {
+	return &ebcdicEncoder{encoder: next, codepage: codepage, records: records}
+}
+
+func (ebcdic *ebcdicEncoder) Write(data []byte) (int, error) {
+	text := append(ebcdic.pending, data...)
+	translated := make([]byte, 0, len(text))
+
+	for len(text) > 0 {
+		// rest of the sequence comes in next write
+		if !utf8.FullRune(text) {
+			break
+		}
+
+		char, size := decodeLocalRune(text)
+		translated = append(translated, ebcdic.codepage.encode(char, ebcdic.records))
+		text = text[size:]
+	}
+
+	ebcdic.pending = slices.Clone(text)
+
+	_, err := ebcdic.encoder.Write(translated)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (ebcdic *ebcdicEncoder) finish() error {
+	// incomplete sequence at the end of file is not UTF-8
+	translated := make([]byte, len(ebcdic.pending))
+	for idx, value := range ebcdic.pending {
+		translated[idx] = ebcdic.codepage.encode(rune(value), ebcdic.records)
+	}
+	ebcdic.pending = nil
+
+	_, err := ebcdic.encoder.Write(translated)
+	if err != nil {
+		return err
+	}
+
+	return ebcdic.encoder.finish()
+}
+
+// ebcdicDecoder translates EBCDIC to local UTF-8 text
+type ebcdicDecoder struct {
+	reader   io.Reader
+	codepage *Codepage
+	records  bool
+	buffer   []byte
+}
+
+func newEBCDICDecoder(reader io.Reader, codepage *Codepage, records bool) *ebcdicDecoder {
+	return &ebcdicDecoder{reader: reader, codepage: codepage, records: records, buffer: make([]byte, CHUNK_SIZE)}
+}
+
+func (ebcdic *ebcdicDecoder) Read(data []byte) (int, error) {
+	// every code page character is encoded in at most 2 bytes of UTF-8
+	size := min(len(data)/utf8.UTFMax, len(ebcdic.buffer))
+	if size == 0 {
+		return 0, fmt.Errorf("buffer for EBCDIC translation is too small")
+	}
+
+	n, err := ebcdic.reader.Read(ebcdic.buffer[:size])
+
+	written := 0
+	for _, value := range ebcdic.buffer[:n] {
+		written += utf8.EncodeRune(data[written:], ebcdic.codepage.decode(value, ebcdic.records))
+	}
+
+	return written, err
+}
+
+// decodeLocalRune decodes UTF-8 character, invalid byte is taken as Latin-1 character
+func decodeLocalRune(text []byte) (rune, int) {
+	char, size := utf8.DecodeRune(text)
+	if char == utf8.RuneError && size <= 1 {
+		return rune(text[0]), 1
+	}
+
+	return char, size
+}
+
+// ebcdicLocalOffset converts offset in data translated to EBCDIC to offset in local text
+func ebcdicLocalOffset(reader io.Reader, ebcdicOffset int64) (int64, error) {
+	var localOffset, translatedOffset int64
+
+	err := scanLocalRunes(reader, func(runeSize int) bool {
+		if translatedOffset == ebcdicOffset {
+			return false
+		}
+
+		localOffset += int64(runeSize)
+		translatedOffset++
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if translatedOffset < ebcdicOffset {
+		return 0, fmt.Errorf("offset %d is after end of file", ebcdicOffset)
+	}
+
+	return localOffset, nil
+}
+
+// scanLocalRunes calls visit with size of every character of local text, until visit returns false
+func scanLocalRunes(reader io.Reader, visit func(runeSize int) bool) error {
+	bufferedReader := bufio.NewReaderSize(reader, CHUNK_SIZE)
+
+	for {
+		text, err := bufferedReader.Peek(utf8.UTFMax)
+		if len(text) == 0 {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading data: %s", err)
+		}
+
+		_, size := decodeLocalRune(text)
+		if !visit(size) {
+			return nil
+		}
+
+		_, _ = bufferedReader.Discard(size)
+	}
+}
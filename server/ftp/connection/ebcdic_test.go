@@ -0,0 +1,219 @@
+package connection
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func ebcdicParameters(codepage string, mode TransmissionMode, structure FileStructure) TransferParameters {
+	return TransferParameters{Type: TYPE_EBCDIC, Format: FORMAT_NON_PRINT, Codepage: codepages[codepage], Mode: mode, Structure: structure}
+}
+
+func TestCodepageNames(t *testing.T) {
+	names := CodepageNames()
+	if !slices.Equal(names, []string{"037", "500", "1047"}) {
+		t.Errorf("CodepageNames() = %v", names)
+	}
+
+	if _, ok := LookupCodepage("1140"); ok {
+		t.Error("unknown codepage found")
+	}
+}
+
+func TestEBCDICRoundTrip(t *testing.T) {
+	text := "Hello, World! [x] {y} é ü ß 0123456789 @#$%\n\tline\n"
+
+	for _, name := range CodepageNames() {
+		for _, structure := range []FileStructure{STRUCTURE_FILE, STRUCTURE_RECORD} {
+			t.Run(name+"/"+string(structure), func(t *testing.T) {
+				parameters := ebcdicParameters(name, MODE_STREAM, structure)
+
+				wire := encodeChunks(t, parameters, text)
+				decoded, err := decodeWire(t, parameters, wire)
+				if err != nil {
+					t.Fatalf("decoding: %s", err)
+				}
+				if string(decoded) != text {
+					t.Errorf("decoded = %q, want %q", decoded, text)
+				}
+			})
+		}
+	}
+}
+
+func TestEBCDICEncoding(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters TransferParameters
+		chunks     []string
+		wire       []byte
+		decoded    string
+	}{
+		{
+			name:       "letters and digits",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"Aa0 "},
+			wire:       []byte{0xC1, 0x81, 0xF0, 0x40},
+			decoded:    "Aa0 ",
+		},
+		{
+			name:       "brackets differ between code pages 037",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"["},
+			wire:       []byte{0xBA},
+			decoded:    "[",
+		},
+		{
+			name:       "brackets differ between code pages 500",
+			parameters: ebcdicParameters("500", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"["},
+			wire:       []byte{0x4A},
+			decoded:    "[",
+		},
+		{
+			name:       "brackets differ between code pages 1047",
+			parameters: ebcdicParameters("1047", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"["},
+			wire:       []byte{0xAD},
+			decoded:    "[",
+		},
+		{
+			name:       "default code page is used without codepage",
+			parameters: TransferParameters{Type: TYPE_EBCDIC, Mode: MODE_STREAM, Structure: STRUCTURE_FILE},
+			chunks:     []string{"["},
+			wire:       []byte{0xBA},
+			decoded:    "[",
+		},
+		{
+			name:       "file structure sends line ending as NL",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"a\n"},
+			wire:       []byte{0x81, 0x15},
+			decoded:    "a\n",
+		},
+		{
+			name:       "character missing in code page is sent as SUB",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"a€b"},
+			wire:       []byte{0x81, EBCDIC_SUB, 0x82},
+			decoded:    "a\x1ab",
+		},
+		{
+			name:       "record separator marks records",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_RECORD),
+			chunks:     []string{"a\nb\n"},
+			wire:       []byte{0x81, STREAM_ESCAPE, STREAM_EOR, 0x82, STREAM_ESCAPE, STREAM_EOR_AND_EOF},
+			decoded:    "a\nb\n",
+		},
+		{
+			name:       "character encoded as record separator byte is sent as SUB in records",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_RECORD),
+			chunks:     []string{"\u008e\n"},
+			wire:       []byte{EBCDIC_SUB, STREAM_ESCAPE, STREAM_EOR_AND_EOF},
+			decoded:    "\x1a\n",
+		},
+		{
+			name:       "record separator byte is data in file structure",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"\u008e"},
+			wire:       []byte{EBCDIC_RECORD_SEPARATOR},
+			decoded:    "\u008e",
+		},
+		{
+			name:       "UTF-8 sequence split across writes",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"a\xc3", "\xa9b"},
+			wire:       []byte{0x81, 0x51, 0x82},
+			decoded:    "aéb",
+		},
+		{
+			name:       "UTF-8 sequence split into three writes",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"\xe2", "\x82", "\xac"},
+			wire:       []byte{EBCDIC_SUB},
+			decoded:    "\x1a",
+		},
+		{
+			name:       "invalid UTF-8 is taken as Latin-1",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"\xe9A"},
+			wire:       []byte{0x51, 0xC1},
+			decoded:    "éA",
+		},
+		{
+			name:       "incomplete sequence at end of file is taken as Latin-1",
+			parameters: ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"A\xc3"},
+			wire:       []byte{0xC1, 0x66},
+			decoded:    "AÃ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wire := encodeChunks(t, test.parameters, test.chunks...)
+			if !bytes.Equal(wire, test.wire) {
+				t.Errorf("wire = % x, want % x", wire, test.wire)
+			}
+
+			decoded, err := decodeWire(t, test.parameters, wire)
+			if err != nil {
+				t.Fatalf("decoding: %s", err)
+			}
+			if string(decoded) != test.decoded {
+				t.Errorf("decoded = %q, want %q", decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestEBCDICTransferSize(t *testing.T) {
+	parameters := ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE)
+
+	// every character is one EBCDIC byte
+	size, err := parameters.TransferSize(strings.NewReader("aé€\n"))
+	if err != nil || size != 4 {
+		t.Errorf("TransferSize = %d, %v, want 4", size, err)
+	}
+}
+
+func TestEBCDICLocalOffset(t *testing.T) {
+	// characters of 1, 2, 3 and 1 bytes
+	local := "aé€b"
+	parameters := ebcdicParameters("037", MODE_STREAM, STRUCTURE_FILE)
+
+	tests := []struct {
+		offset int64
+		want   int64
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 3},
+		{3, 6},
+		{4, 7},
+	}
+
+	for _, test := range tests {
+		offset, err := parameters.LocalOffset(strings.NewReader(local), test.offset)
+		if err != nil {
+			t.Errorf("LocalOffset(%d): %s", test.offset, err)
+			continue
+		}
+		if offset != test.want {
+			t.Errorf("LocalOffset(%d) = %d, want %d", test.offset, offset, test.want)
+		}
+	}
+
+	_, err := parameters.LocalOffset(strings.NewReader(local), 5)
+	if err == nil {
+		t.Error("offset after end of file accepted")
+	}
+
+	// invalid UTF-8 byte is one character
+	offset, err := parameters.LocalOffset(strings.NewReader("\xe9\xe9a"), 2)
+	if err != nil || offset != 2 {
+		t.Errorf("LocalOffset of Latin-1 text = %d, %v, want 2", offset, err)
+	}
+}
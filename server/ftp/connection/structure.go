@@ -0,0 +1,226 @@
+package connection
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type FileStructure string
+
+const (
+	STRUCTURE_FILE   FileStructure = "F"
+	STRUCTURE_RECORD FileStructure = "R"
+	STRUCTURE_PAGE   FileStructure = "P"
+)
+
+// records are stored in local files as lines, record boundary is this byte
+const RECORD_SEPARATOR = '\n'
+
+// stream mode marks record boundaries with escape byte followed by control code, escape byte in data is doubled
+const (
+	STREAM_ESCAPE      = 0xFF
+	STREAM_EOR         = 0x01
+	STREAM_EOF         = 0x02
+	STREAM_EOR_AND_EOF = 0x03
+)
+
+// TransferParameters describe how data is represented on data connection
+type TransferParameters struct {
+	Type      DataType
+	Format    DataFormat // only used by ASCII and EBCDIC types
+	Codepage  *Codepage  // used by EBCDIC type, nil means DEFAULT_CODEPAGE
+	Mode      TransmissionMode
+	Structure FileStructure
+}
+
+// encoder converts local data to representation sent over data connection
+type encoder interface {
+	io.Writer
+	// finish marks end of file, it is called once after all data was written
+	finish() error
+}
+
+func newEncoder(parameters TransferParameters, writer io.Writer) (encoder, error) {
+	modeEncoder, err := newModeEncoder(parameters, writer)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDataEncoder(parameters, modeEncoder), nil
+}
+
+// newModeEncoder returns encoder of transmission mode and structure
+func newModeEncoder(parameters TransferParameters, writer io.Writer) (encoder, error) {
+	if parameters.Structure != STRUCTURE_FILE && parameters.Structure != STRUCTURE_RECORD {
+		return nil, fmt.Errorf("unsupported structure %s", parameters.Structure)
+	}
+
+	records := parameters.Structure == STRUCTURE_RECORD
+
+	switch parameters.Mode {
+	case MODE_STREAM:
+		if records {
+			return &streamRecordEncoder{writer: writer}, nil
+		}
+		// end of file is marked by closing the connection
+		return &streamFileEncoder{Writer: writer}, nil
+	case MODE_BLOCK:
+		return newBlockEncoder(writer, records), nil
+	default:
+		return nil, fmt.Errorf("unsupported mode %s", parameters.Mode)
+	}
+}
+
+// newDecoder returns reader of local data, it returns io.EOF when sender marked end of file
+func newDecoder(parameters TransferParameters, reader *bufio.Reader) (io.Reader, error) {
+	modeDecoder, err := newModeDecoder(parameters, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDataDecoder(parameters, modeDecoder), nil
+}
+
+// newModeDecoder returns decoder of transmission mode and structure
+func newModeDecoder(parameters TransferParameters, reader *bufio.Reader) (io.Reader, error) {
+	if parameters.Structure != STRUCTURE_FILE && parameters.Structure != STRUCTURE_RECORD {
+		return nil, fmt.Errorf("unsupported structure %s", parameters.Structure)
+	}
+
+	records := parameters.Structure == STRUCTURE_RECORD
+
+	switch parameters.Mode {
+	case MODE_STREAM:
+		if records {
+			return &streamRecordDecoder{reader: reader}, nil
+		}
+		return reader, nil
+	case MODE_BLOCK:
+		return newBlockDecoder(reader, records), nil
+	default:
+		return nil, fmt.Errorf("unsupported mode %s", parameters.Mode)
+	}
+}
+
+type streamFileEncoder struct {
+	io.Writer
+}
+
+func (streamFileEncoder) finish() error {
+	return nil
+}
+
+// streamRecordEncoder replaces record separators with EOR markers. Marker of the last record is held back,
+// so it can be merged with EOF.
+type streamRecordEncoder struct {
+	writer     io.Writer
+	pendingEOR bool
+	hasData    bool // data of unfinished record were written
+}
+
+func (encoder *streamRecordEncoder) Write(data []byte) (int, error) {
+	encoded := make([]byte, 0, len(data)+8)
+
+	for _, value := range data {
+		if encoder.pendingEOR {
+			encoded = append(encoded, STREAM_ESCAPE, STREAM_EOR)
+			encoder.pendingEOR = false
+		}
+
+		switch value {
+		case RECORD_SEPARATOR:
+			encoder.pendingEOR = true
+			encoder.hasData = false
+		case STREAM_ESCAPE:
+			encoded = append(encoded, STREAM_ESCAPE, STREAM_ESCAPE)
+			encoder.hasData = true
+		default:
+			encoded = append(encoded, value)
+			encoder.hasData = true
+		}
+	}
+
+	_, err := encoder.writer.Write(encoded)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (encoder *streamRecordEncoder) finish() error {
+	marker := byte(STREAM_EOF)
+
+	// last record without separator is still a record
+	if encoder.pendingEOR || encoder.hasData {
+		marker = STREAM_EOR_AND_EOF
+	}
+
+	_, err := encoder.writer.Write([]byte{STREAM_ESCAPE, marker})
+	return err
+}
+
+// streamRecordDecoder replaces EOR markers with record separators
+type streamRecordDecoder struct {
+	reader    *bufio.Reader
+	endOfFile bool
+}
+
+// ErrInvalidRecordMarker is returned when escape byte is followed by unknown control code
+var ErrInvalidRecordMarker = errors.New("invalid record marker")
+
+func (decoder *streamRecordDecoder) Read(data []byte) (int, error) {
+	if decoder.endOfFile {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(data) {
+		// only block when nothing was decoded yet
+		if n > 0 && decoder.reader.Buffered() == 0 {
+			break
+		}
+
+		value, err := decoder.reader.ReadByte()
+		if err != nil {
+			return n, err
+		}
+
+		if value != STREAM_ESCAPE {
+			data[n] = value
+			n++
+			continue
+		}
+
+		code, err := decoder.reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+
+		switch code {
+		case STREAM_ESCAPE:
+			data[n] = STREAM_ESCAPE
+			n++
+		case STREAM_EOR:
+			data[n] = RECORD_SEPARATOR
+			n++
+		case STREAM_EOF:
+			decoder.endOfFile = true
+			return n, nil
+		case STREAM_EOR_AND_EOF:
+			data[n] = RECORD_SEPARATOR
+			n++
+			decoder.endOfFile = true
+			return n, nil
+		default:
+			return n, fmt.Errorf("%w 0x%02x", ErrInvalidRecordMarker, code)
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,287 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// encodeChunks encodes chunks written one by one and returns data sent over data connection
+func encodeChunks(t *testing.T, parameters TransferParameters, chunks ...string) []byte {
+	t.Helper()
+
+	wire := &bytes.Buffer{}
+	dataEncoder, err := newEncoder(parameters, wire)
+	if err != nil {
+		t.Fatalf("newEncoder: %s", err)
+	}
+
+	for _, chunk := range chunks {
+		_, err = dataEncoder.Write([]byte(chunk))
+		if err != nil {
+			t.Fatalf("encoding %q: %s", chunk, err)
+		}
+	}
+
+	err = dataEncoder.finish()
+	if err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+
+	return wire.Bytes()
+}
+
+// decodeWire returns local data decoded from data received over data connection
+func decodeWire(t *testing.T, parameters TransferParameters, wire []byte) ([]byte, error) {
+	t.Helper()
+
+	dataDecoder, err := newDecoder(parameters, bufio.NewReader(bytes.NewReader(wire)))
+	if err != nil {
+		t.Fatalf("newDecoder: %s", err)
+	}
+
+	return io.ReadAll(dataDecoder)
+}
+
+func imageParameters(mode TransmissionMode, structure FileStructure) TransferParameters {
+	return TransferParameters{Type: TYPE_IMAGE, Mode: mode, Structure: structure}
+}
+
+func TestModeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters TransferParameters
+		chunks     []string
+		wire       []byte
+		decoded    string
+	}{
+		{
+			name:       "stream file is sent unchanged",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_FILE),
+			chunks:     []string{"a\n\xff", "b"},
+			wire:       []byte("a\n\xffb"),
+			decoded:    "a\n\xffb",
+		},
+		{
+			name:       "stream records merge last EOR with EOF",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_RECORD),
+			chunks:     []string{"a\nb\n"},
+			wire:       []byte{'a', STREAM_ESCAPE, STREAM_EOR, 'b', STREAM_ESCAPE, STREAM_EOR_AND_EOF},
+			decoded:    "a\nb\n",
+		},
+		{
+			name:       "stream records separator split across writes",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_RECORD),
+			chunks:     []string{"a", "\n", "b\n"},
+			wire:       []byte{'a', STREAM_ESCAPE, STREAM_EOR, 'b', STREAM_ESCAPE, STREAM_EOR_AND_EOF},
+			decoded:    "a\nb\n",
+		},
+		{
+			name:       "stream records escape byte 255",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_RECORD),
+			chunks:     []string{"a\xffb\n"},
+			wire:       []byte{'a', STREAM_ESCAPE, STREAM_ESCAPE, 'b', STREAM_ESCAPE, STREAM_EOR_AND_EOF},
+			decoded:    "a\xffb\n",
+		},
+		{
+			name:       "stream records last record without separator",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_RECORD),
+			chunks:     []string{"a"},
+			wire:       []byte{'a', STREAM_ESCAPE, STREAM_EOR_AND_EOF},
+			decoded:    "a\n",
+		},
+		{
+			name:       "stream records empty records",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_RECORD),
+			chunks:     []string{"\n\n"},
+			wire:       []byte{STREAM_ESCAPE, STREAM_EOR, STREAM_ESCAPE, STREAM_EOR_AND_EOF},
+			decoded:    "\n\n",
+		},
+		{
+			name:       "stream records empty file",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_RECORD),
+			wire:       []byte{STREAM_ESCAPE, STREAM_EOF},
+			decoded:    "",
+		},
+		{
+			name:       "block file ends with EOF block",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_FILE),
+			chunks:     []string{"ab", "c\n"},
+			wire:       []byte{BLOCK_EOF, 0, 4, 'a', 'b', 'c', '\n'},
+			decoded:    "abc\n",
+		},
+		{
+			name:       "block empty file",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_FILE),
+			wire:       []byte{BLOCK_EOF, 0, 0},
+			decoded:    "",
+		},
+		{
+			name:       "block records merge last EOR with EOF",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_RECORD),
+			chunks:     []string{"a\nb\n"},
+			wire:       []byte{BLOCK_EOR, 0, 1, 'a', BLOCK_EOR | BLOCK_EOF, 0, 1, 'b'},
+			decoded:    "a\nb\n",
+		},
+		{
+			name:       "block records last record without separator",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_RECORD),
+			chunks:     []string{"a\n", "b"},
+			wire:       []byte{BLOCK_EOR, 0, 1, 'a', BLOCK_EOR | BLOCK_EOF, 0, 1, 'b'},
+			decoded:    "a\nb\n",
+		},
+		{
+			name:       "block records empty records",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_RECORD),
+			chunks:     []string{"a\n\n"},
+			wire:       []byte{BLOCK_EOR, 0, 1, 'a', BLOCK_EOR | BLOCK_EOF, 0, 0},
+			decoded:    "a\n\n",
+		},
+		{
+			name:       "block records byte 255 needs no escaping",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_RECORD),
+			chunks:     []string{"\xff\n"},
+			wire:       []byte{BLOCK_EOR | BLOCK_EOF, 0, 1, 0xFF},
+			decoded:    "\xff\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wire := encodeChunks(t, test.parameters, test.chunks...)
+			if !bytes.Equal(wire, test.wire) {
+				t.Errorf("wire = %v, want %v", wire, test.wire)
+			}
+
+			decoded, err := decodeWire(t, test.parameters, wire)
+			if err != nil {
+				t.Fatalf("decoding: %s", err)
+			}
+			if string(decoded) != test.decoded {
+				t.Errorf("decoded = %q, want %q", decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestBlockSplitsLargeData(t *testing.T) {
+	parameters := imageParameters(MODE_BLOCK, STRUCTURE_FILE)
+	data := bytes.Repeat([]byte{'x'}, MAX_BLOCK_SIZE+10)
+
+	wire := encodeChunks(t, parameters, string(data))
+
+	if len(wire) != len(data)+2*BLOCK_HEADER_SIZE {
+		t.Fatalf("wire has %d bytes, want two blocks", len(wire))
+	}
+	if !bytes.Equal(wire[:BLOCK_HEADER_SIZE], []byte{0, 0xFF, 0xFF}) {
+		t.Errorf("first header = %v", wire[:BLOCK_HEADER_SIZE])
+	}
+	second := wire[BLOCK_HEADER_SIZE+MAX_BLOCK_SIZE:][:BLOCK_HEADER_SIZE]
+	if !bytes.Equal(second, []byte{BLOCK_EOF, 0, 10}) {
+		t.Errorf("second header = %v", second)
+	}
+
+	decoded, err := decodeWire(t, parameters, wire)
+	if err != nil {
+		t.Fatalf("decoding: %s", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Errorf("decoded %d bytes, want %d", len(decoded), len(data))
+	}
+}
+
+func TestModeDecodeReceivedData(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters TransferParameters
+		wire       []byte
+		decoded    string
+		err        error
+	}{
+		{
+			name:       "block restart marker is skipped",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_FILE),
+			wire:       []byte{BLOCK_RESTART_MARKER, 0, 2, '1', '2', BLOCK_EOF, 0, 1, 'a'},
+			decoded:    "a",
+		},
+		{
+			name:       "block EOR is ignored in file structure",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_FILE),
+			wire:       []byte{BLOCK_EOR, 0, 1, 'a', BLOCK_EOF, 0, 1, 'b'},
+			decoded:    "ab",
+		},
+		{
+			name:       "block connection closed without EOF block",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_FILE),
+			wire:       []byte{0, 0, 1, 'a'},
+			decoded:    "a",
+			err:        ErrMissingEndOfFile,
+		},
+		{
+			name:       "block connection closed inside block",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_FILE),
+			wire:       []byte{BLOCK_EOF, 0, 5, 'a', 'b'},
+			decoded:    "ab",
+			err:        io.ErrUnexpectedEOF,
+		},
+		{
+			name:       "block connection closed inside header",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_FILE),
+			wire:       []byte{BLOCK_EOF, 0},
+			err:        io.ErrUnexpectedEOF,
+		},
+		{
+			name:       "block data after EOF block are not read",
+			parameters: imageParameters(MODE_BLOCK, STRUCTURE_FILE),
+			wire:       []byte{BLOCK_EOF, 0, 1, 'a', 0, 0, 1, 'b'},
+			decoded:    "a",
+		},
+		{
+			name:       "stream records unknown marker",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_RECORD),
+			wire:       []byte{'a', STREAM_ESCAPE, 0x07},
+			decoded:    "a",
+			err:        ErrInvalidRecordMarker,
+		},
+		{
+			name:       "stream records connection closed after escape",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_RECORD),
+			wire:       []byte{'a', STREAM_ESCAPE},
+			decoded:    "a",
+			err:        io.ErrUnexpectedEOF,
+		},
+		{
+			name:       "stream records data after EOF are not read",
+			parameters: imageParameters(MODE_STREAM, STRUCTURE_RECORD),
+			wire:       []byte{'a', STREAM_ESCAPE, STREAM_EOF, 'b'},
+			decoded:    "a",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := decodeWire(t, test.parameters, test.wire)
+
+			if !errors.Is(err, test.err) {
+				t.Errorf("error = %v, want %v", err, test.err)
+			}
+			if string(decoded) != test.decoded {
+				t.Errorf("decoded = %q, want %q", decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestUnsupportedModeAndStructure(t *testing.T) {
+	_, err := newEncoder(imageParameters(MODE_COMPRESSED, STRUCTURE_FILE), io.Discard)
+	if err == nil {
+		t.Error("compressed mode accepted by encoder")
+	}
+
+	_, err = newDecoder(imageParameters(MODE_STREAM, STRUCTURE_PAGE), bufio.NewReader(bytes.NewReader(nil)))
+	if err == nil {
+		t.Error("page structure accepted by decoder")
+	}
+}
@@ -0,0 +1,186 @@
+package connection
+
+import (
+	"log"
+	"strings"
+)
+
+// telnet commands, see telnet_interupts.md
+const (
+	TELNET_SE        = 240 // end of subnegotiation
+	TELNET_NOP       = 241
+	TELNET_DATA_MARK = 242 // data stream portion of Synch, sent as TCP urgent data
+	TELNET_BREAK     = 243
+	TELNET_IP        = 244 // interrupt process
+	TELNET_AO        = 245 // abort output
+	TELNET_AYT       = 246 // are you there
+	TELNET_EC        = 247 // erase character
+	TELNET_EL        = 248 // erase line
+	TELNET_GA        = 249 // go ahead
+	TELNET_SB        = 250 // start of subnegotiation
+	TELNET_WILL      = 251
+	TELNET_WONT      = 252
+	TELNET_DO        = 253
+	TELNET_DONT      = 254
+	TELNET_IAC       = 255 // interpret as command
+	TELNET_CR        = '\r'
+	TELNET_LF        = '\n'
+	TELNET_NUL       = 0
+)
+
+type telnetState int
+
+const (
+	TELNET_STATE_DATA    telnetState = iota
+	TELNET_STATE_IAC                 // previous byte was IAC
+	TELNET_STATE_OPTION              // previous bytes were IAC and DO, DONT, WILL or WONT
+	TELNET_STATE_SUB                 // inside subnegotiation
+	TELNET_STATE_SUB_IAC             // IAC inside subnegotiation
+	TELNET_STATE_CR                  // previous byte was CR
+)
+
+// telnetParser assembles command lines from Telnet NVT stream of control connection.
+// Telnet commands are removed from the line wherever they are, IAC IAC is data byte 255.
+// Client can only negotiate options off, every DO and WILL is refused.
+type telnetParser struct {
+	state         telnetState
+	command       byte // option command waiting for option code
+	line          []byte
+	maxLineLength int  // 0 means unlimited
+	lineTooLong   bool // rest of too long line is skipped
+}
+
+func newTelnetParser(maxLineLength int) *telnetParser {
+	return &telnetParser{state: TELNET_STATE_DATA, maxLineLength: maxLineLength}
+}
+
+// feed processes one byte from the client. lineComplete is set when the byte finished command line,
+// reply holds negotiation answer that has to be sent back to the client.
+func (parser *telnetParser) feed(data byte) (lineComplete bool, reply []byte) {
+	switch parser.state {
+	case TELNET_STATE_IAC:
+		return false, parser.feedCommand(data)
+
+	case TELNET_STATE_OPTION:
+		parser.state = TELNET_STATE_DATA
+		return false, negotiationReply(parser.command, data)
+
+	case TELNET_STATE_SUB:
+		if data == TELNET_IAC {
+			parser.state = TELNET_STATE_SUB_IAC
+		}
+		return false, nil
+
+	case TELNET_STATE_SUB_IAC:
+		parser.state = TELNET_STATE_SUB
+		if data == TELNET_SE {
+			parser.state = TELNET_STATE_DATA
+		}
+		return false, nil
+
+	case TELNET_STATE_CR:
+		parser.state = TELNET_STATE_DATA
+		switch data {
+		case TELNET_LF:
+			return true, nil
+		case TELNET_NUL:
+			// CR NUL is bare carriage return
+			parser.appendData(TELNET_CR)
+			return false, nil
+		default:
+			parser.appendData(TELNET_CR)
+			return parser.feed(data)
+		}
+	}
+
+	switch data {
+	case TELNET_IAC:
+		parser.state = TELNET_STATE_IAC
+	case TELNET_CR:
+		parser.state = TELNET_STATE_CR
+	case TELNET_LF:
+		// some clients end lines with LF only
+		return true, nil
+	default:
+		parser.appendData(data)
+	}
+
+	return false, nil
+}
+
+// feedCommand processes byte following IAC
+func (parser *telnetParser) feedCommand(command byte) []byte {
+	parser.state = TELNET_STATE_DATA
+
+	switch command {
+	case TELNET_IAC:
+		parser.appendData(TELNET_IAC)
+	case TELNET_DO, TELNET_DONT, TELNET_WILL, TELNET_WONT:
+		parser.command = command
+		parser.state = TELNET_STATE_OPTION
+	case TELNET_SB:
+		parser.state = TELNET_STATE_SUB
+	case TELNET_IP, TELNET_DATA_MARK:
+		// interrupt and Synch cancel command that was being typed, ABOR follows
+		log.Printf("telnet interrupt received (%d), discarding partial line", command)
+		parser.line = parser.line[:0]
+		parser.lineTooLong = false
+	case TELNET_EC:
+		if len(parser.line) > 0 {
+			parser.line = parser.line[:len(parser.line)-1]
+		}
+	case TELNET_EL:
+		parser.line = parser.line[:0]
+	default:
+		// NOP, BRK, AO, AYT and GA have no meaning for FTP
+	}
+
+	return nil
+}
+
+func (parser *telnetParser) appendData(data byte) {
+	if parser.lineTooLong {
+		return
+	}
+
+	if parser.maxLineLength > 0 && len(parser.line) >= parser.maxLineLength {
+		parser.line = parser.line[:0]
+		parser.lineTooLong = true
+		return
+	}
+
+	parser.line = append(parser.line, data)
+}
+
+// takeLine returns assembled line and prepares parser for the next one.
+// tooLong is set when the line exceeded maximum length, the line is then discarded.
+func (parser *telnetParser) takeLine() (line string, tooLong bool) {
+	line = string(parser.line)
+	tooLong = parser.lineTooLong
+
+	parser.line = parser.line[:0]
+	parser.lineTooLong = false
+
+	if tooLong {
+		return "", true
+	}
+
+	return line, false
+}
+
+// escapeIAC doubles byte 255 in outgoing text, single IAC would start Telnet command
+func escapeIAC(text string) string {
+	return strings.ReplaceAll(text, string([]byte{TELNET_IAC}), string([]byte{TELNET_IAC, TELNET_IAC}))
+}
+
+// negotiationReply refuses every option, DONT and WONT need no answer because options are already off
+func negotiationReply(command byte, option byte) []byte {
+	switch command {
+	case TELNET_DO:
+		return []byte{TELNET_IAC, TELNET_WONT, option}
+	case TELNET_WILL:
+		return []byte{TELNET_IAC, TELNET_DONT, option}
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package connection
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// feedAll passes input to parser and returns completed lines, too long lines are returned as "<too long>"
+func feedAll(parser *telnetParser, input []byte) (lines []string, replies []byte) {
+	for _, data := range input {
+		lineComplete, reply := parser.feed(data)
+		replies = append(replies, reply...)
+
+		if lineComplete {
+			line, tooLong := parser.takeLine()
+			if tooLong {
+				line = "<too long>"
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, replies
+}
+
+func TestTelnetParser(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         []byte
+		maxLineLength int
+		lines         []string
+		replies       []byte
+	}{
+		{
+			name:  "CRLF and bare LF end lines",
+			input: []byte("USER a\r\nPASS b\nNOOP\r\n"),
+			lines: []string{"USER a", "PASS b", "NOOP"},
+		},
+		{
+			name:  "IAC IAC is data byte 255",
+			input: []byte("CWD a\xff\xffb\r\n"),
+			lines: []string{"CWD a\xffb"},
+		},
+		{
+			name:  "CR NUL is bare carriage return",
+			input: []byte("CWD a\r\x00b\r\n"),
+			lines: []string{"CWD a\rb"},
+		},
+		{
+			name:  "CR followed by other byte keeps both",
+			input: []byte("CWD a\rb\r\n"),
+			lines: []string{"CWD a\rb"},
+		},
+		{
+			name:  "IP and DM in the middle of line discard typed part",
+			input: []byte{'R', 'E', 'T', 'R', TELNET_IAC, TELNET_IP, TELNET_IAC, TELNET_DATA_MARK, 'A', 'B', 'O', 'R', '\r', '\n'},
+			lines: []string{"ABOR"},
+		},
+		{
+			name:  "subnegotiation is skipped including IAC IAC inside",
+			input: []byte{'N', 'O', TELNET_IAC, TELNET_SB, 24, 1, TELNET_IAC, TELNET_IAC, 2, TELNET_IAC, TELNET_SE, 'O', 'P', '\r', '\n'},
+			lines: []string{"NOOP"},
+		},
+		{
+			name:    "DO and WILL are refused",
+			input:   []byte{TELNET_IAC, TELNET_DO, 1, TELNET_IAC, TELNET_WILL, 3, 'N', 'O', 'O', 'P', '\r', '\n'},
+			lines:   []string{"NOOP"},
+			replies: []byte{TELNET_IAC, TELNET_WONT, 1, TELNET_IAC, TELNET_DONT, 3},
+		},
+		{
+			name:  "DONT and WONT need no answer",
+			input: []byte{TELNET_IAC, TELNET_DONT, 1, TELNET_IAC, TELNET_WONT, 3, 'N', 'O', 'O', 'P', '\r', '\n'},
+			lines: []string{"NOOP"},
+		},
+		{
+			name:  "EC and EL edit the line",
+			input: []byte{'X', TELNET_IAC, TELNET_EL, 'N', 'O', 'O', 'P', 'S', TELNET_IAC, TELNET_EC, '\r', '\n'},
+			lines: []string{"NOOP"},
+		},
+		{
+			name:  "NOP and AYT are ignored",
+			input: []byte{'N', 'O', TELNET_IAC, TELNET_NOP, 'O', 'P', TELNET_IAC, TELNET_AYT, '\r', '\n'},
+			lines: []string{"NOOP"},
+		},
+		{
+			name:          "over-length line is discarded and next line is read",
+			input:         []byte("STOR abcdefgh\r\nNOOP\r\n"),
+			maxLineLength: 8,
+			lines:         []string{"<too long>", "NOOP"},
+		},
+		{
+			name:          "line of maximum length is accepted",
+			input:         []byte("RETR abc\r\n"),
+			maxLineLength: 8,
+			lines:         []string{"RETR abc"},
+		},
+		{
+			name:          "interrupt clears over-length state",
+			input:         []byte{'S', 'T', 'O', 'R', ' ', 'a', 'b', 'c', 'd', 'e', TELNET_IAC, TELNET_IP, 'A', 'B', 'O', 'R', '\r', '\n'},
+			maxLineLength: 8,
+			lines:         []string{"ABOR"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines, replies := feedAll(newTelnetParser(test.maxLineLength), test.input)
+
+			if !slices.Equal(lines, test.lines) {
+				t.Errorf("lines = %q, want %q", lines, test.lines)
+			}
+			if !bytes.Equal(replies, test.replies) {
+				t.Errorf("replies = %v, want %v", replies, test.replies)
+			}
+		})
+	}
+}
+
+func TestTelnetParserLineSplitAcrossFeeds(t *testing.T) {
+	parser := newTelnetParser(0)
+
+	lines, _ := feedAll(parser, []byte("CWD a\xff"))
+	if len(lines) != 0 {
+		t.Fatalf("unexpected lines %q before end of line", lines)
+	}
+
+	lines, _ = feedAll(parser, []byte("\xffb\r"))
+	if len(lines) != 0 {
+		t.Fatalf("unexpected lines %q before LF", lines)
+	}
+
+	lines, _ = feedAll(parser, []byte("\n"))
+	if !slices.Equal(lines, []string{"CWD a\xffb"}) {
+		t.Errorf("lines = %q", lines)
+	}
+}
+
+func TestEscapeIAC(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"550 a.txt: No such file or directory.\r\n", "550 a.txt: No such file or directory.\r\n"},
+		{"550 a\xffb: No such file or directory.\r\n", "550 a\xff\xffb: No such file or directory.\r\n"},
+		{"\xff\xff", "\xff\xff\xff\xff"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := escapeIAC(test.text); got != test.want {
+			t.Errorf("escapeIAC(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+
+	// escaped reply is read back unchanged by the parser
+	lines, _ := feedAll(newTelnetParser(0), []byte(escapeIAC("a\xffb\r\n")))
+	if !slices.Equal(lines, []string{"a\xffb"}) {
+		t.Errorf("round trip = %q", lines)
+	}
+}
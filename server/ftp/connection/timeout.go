@@ -0,0 +1,64 @@
+package connection
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// transferConn extends deadline before every read and write,
+// so transfer only fails when no data moved for the whole idle timeout, not when it takes long.
+// Interrupted connection gets deadline in the past, which unblocks read or write in progress.
+type transferConn struct {
+	net.Conn
+	timeout     time.Duration // 0 means no idle timeout
+	lock        *sync.Mutex   // guards deadline changes, so interrupt can not be overwritten by next read
+	interrupted bool
+}
+
+func newTransferConn(conn net.Conn, timeout time.Duration) *transferConn {
+	return &transferConn{Conn: conn, timeout: timeout, lock: &sync.Mutex{}}
+}
+
+func (conn *transferConn) Read(data []byte) (int, error) {
+	err := conn.extendDeadline(conn.Conn.SetReadDeadline)
+	if err != nil {
+		return 0, err
+	}
+
+	return conn.Conn.Read(data)
+}
+
+func (conn *transferConn) Write(data []byte) (int, error) {
+	err := conn.extendDeadline(conn.Conn.SetWriteDeadline)
+	if err != nil {
+		return 0, err
+	}
+
+	return conn.Conn.Write(data)
+}
+
+func (conn *transferConn) extendDeadline(setDeadline func(time.Time) error) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.interrupted {
+		return os.ErrDeadlineExceeded
+	}
+
+	if conn.timeout <= 0 {
+		return nil
+	}
+
+	return setDeadline(time.Now().Add(conn.timeout))
+}
+
+// interrupt makes pending and all future reads and writes fail immediately
+func (conn *transferConn) interrupt() {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.interrupted = true
+	_ = conn.Conn.SetDeadline(time.Unix(1, 0))
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package connection
+
+import "net"
+
+// enableInlineUrgentData is not supported, Data Mark sent as urgent data may be lost
+func enableInlineUrgentData(rawConnection *net.Conn) {}
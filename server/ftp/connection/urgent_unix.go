@@ -0,0 +1,36 @@
+//go:build unix
+
+package connection
+
+import (
+	"log"
+	"net"
+	"syscall"
+)
+
+// enableInlineUrgentData makes TCP urgent data part of normal stream. Clients send Data Mark of Telnet Synch
+// as urgent data, without SO_OOBINLINE the kernel removes it from the stream and IAC before it would swallow next byte.
+// TLS connections are left untouched, Synch is then sent in-band.
+func enableInlineUrgentData(rawConnection *net.Conn) {
+	tcpConnection, ok := (*rawConnection).(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	rawSocket, err := tcpConnection.SyscallConn()
+	if err != nil {
+		log.Printf("cannot enable inline urgent data: %s", err)
+		return
+	}
+
+	var optionErr error
+	err = rawSocket.Control(func(fd uintptr) {
+		optionErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_OOBINLINE, 1)
+	})
+	if err == nil {
+		err = optionErr
+	}
+	if err != nil {
+		log.Printf("cannot enable inline urgent data: %s", err)
+	}
+}
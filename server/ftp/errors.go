@@ -1,26 +1,123 @@
 package ftp
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"server/fs"
+	"server/respones"
+)
 
+// ServerError is returned by command handlers, client is sent its status code and respondMessage,
+// msg is only logged. Session is closed after the reply when terminateSession is set.
 type ServerError struct {
 	msg              string
 	respondMessage   string
 	statusCode       int
 	terminateSession bool
+	cause            error
 }
 
 func NewError(msg string, respondMessage string, statusCode int, terminateSession bool) *ServerError {
 	return &ServerError{
 		msg:              msg,
+		respondMessage:   respondMessage,
 		statusCode:       statusCode,
 		terminateSession: terminateSession,
 	}
 }
 
+// wrap sets error that caused this one, so it is logged and can be inspected by errors.Is and errors.As
+func (e *ServerError) wrap(cause error) *ServerError {
+	e.cause = cause
+	return e
+}
+
 func (e *ServerError) Error() string {
-	return fmt.Sprintf("%d %s", e.statusCode, e.respondMessage)
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %s", e.msg, e.cause)
+	}
+
+	return e.msg
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.cause
+}
+
+func (e *ServerError) StatusCode() int {
+	return e.statusCode
+}
+
+// Reply returns reply sent to client
+func (e *ServerError) Reply() respones.Reply {
+	return respones.NewReply(e.statusCode, e.respondMessage)
 }
 
 func (e *ServerError) ShouldTerminate() bool {
 	return e.terminateSession
 }
+
+// toServerError returns err as ServerError, errors without status code are local processing errors
+func toServerError(err error) *ServerError {
+	var serverError *ServerError
+	if errors.As(err, &serverError) {
+		return serverError
+	}
+
+	return NewError("error in processing", "Requested action aborted: local error in processing.", 451, false).wrap(err)
+}
+
+// errorReply logs error of command that already started and returns reply that finishes it
+func errorReply(err error) respones.Reply {
+	serverError := toServerError(err)
+	log.Printf("Error handling command: %s", serverError)
+
+	return serverError.Reply()
+}
+
+var errNotLoggedIn = NewError("command requires login", "Not logged in.", 530, false)
+
+func newSyntaxError(msg string) *ServerError {
+	return NewError(msg, "Syntax error in parameters or arguments.", 501, false)
+}
+
+func newUnsupportedParameterError(msg string) *ServerError {
+	return NewError(msg, "Command not implemented for that parameter.", 504, false)
+}
+
+func newBadSequenceError(msg string) *ServerError {
+	return NewError(msg, "Bad sequence of commands.", 503, false)
+}
+
+// newFileError describes failure of filesystem operation on existing file
+func newFileError(path string, err error) *ServerError {
+	var notFound fs.NotFoundError
+	switch {
+	case errors.As(err, &notFound):
+		return NewError("file not found", fmt.Sprintf("%s: No such file or directory.", path), 550, false).wrap(err)
+	case isPermissionError(err):
+		return NewError("permission denied", fmt.Sprintf("%s: Permission denied.", path), 550, false).wrap(err)
+	default:
+		return toServerError(err)
+	}
+}
+
+// newStoreError describes failure of filesystem operation that creates file under path,
+// name that can not be created is reported with 553
+func newStoreError(path string, err error) *ServerError {
+	if isPermissionError(err) {
+		return NewError("permission denied", fmt.Sprintf("%s: File name not allowed.", path), 553, false).wrap(err)
+	}
+	if errors.Is(err, os.ErrExist) {
+		return NewError("file exists", fmt.Sprintf("%s: File exists.", path), 550, false).wrap(err)
+	}
+
+	return newFileError(path, err)
+}
+
+func isPermissionError(err error) bool {
+	var permissionError fs.PermissionError
+	return errors.As(err, &permissionError) || errors.Is(err, os.ErrPermission)
+}
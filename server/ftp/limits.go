@@ -0,0 +1,73 @@
+package ftp
+
+import (
+	"sync"
+)
+
+// sessionLimits counts open sessions, so the server can refuse clients over configured limits
+type sessionLimits struct {
+	lock    *sync.Mutex
+	total   int
+	perIP   map[string]int
+	perUser map[string]int
+}
+
+func newSessionLimits() *sessionLimits {
+	return &sessionLimits{
+		lock:    &sync.Mutex{},
+		perIP:   make(map[string]int),
+		perUser: make(map[string]int),
+	}
+}
+
+// acquireConnection reserves place for new session from ip, false means that some limit is reached
+func (limits *sessionLimits) acquireConnection(settings Settings, ip string) bool {
+	limits.lock.Lock()
+	defer limits.lock.Unlock()
+
+	if settings.MaxSessions > 0 && limits.total >= settings.MaxSessions {
+		return false
+	}
+
+	if settings.MaxSessionsPerIP > 0 && limits.perIP[ip] >= settings.MaxSessionsPerIP {
+		return false
+	}
+
+	limits.total++
+	limits.perIP[ip]++
+	return true
+}
+
+func (limits *sessionLimits) releaseConnection(ip string) {
+	limits.lock.Lock()
+	defer limits.lock.Unlock()
+
+	limits.total--
+	limits.perIP[ip]--
+	if limits.perIP[ip] <= 0 {
+		delete(limits.perIP, ip)
+	}
+}
+
+// acquireUser reserves place for logged in user, false means that user has too many sessions
+func (limits *sessionLimits) acquireUser(settings Settings, username string) bool {
+	limits.lock.Lock()
+	defer limits.lock.Unlock()
+
+	if settings.MaxSessionsPerUser > 0 && limits.perUser[username] >= settings.MaxSessionsPerUser {
+		return false
+	}
+
+	limits.perUser[username]++
+	return true
+}
+
+func (limits *sessionLimits) releaseUser(username string) {
+	limits.lock.Lock()
+	defer limits.lock.Unlock()
+
+	limits.perUser[username]--
+	if limits.perUser[username] <= 0 {
+		delete(limits.perUser, username)
+	}
+}
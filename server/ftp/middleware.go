@@ -0,0 +1,71 @@
+package ftp
+
+import (
+	"server/respones"
+)
+
+// Command is parsed command line, Name is always upper case
+type Command struct {
+	Name     string
+	Argument string
+}
+
+// CommandHandler handles command of the session and returns reply sent to client.
+// When error is returned, client gets reply of the ServerError instead (451 for other errors)
+// and the session is closed if the error says so.
+type CommandHandler func(session *SessionInfo, command Command) (respones.Reply, error)
+
+// Middleware wraps command handling. It can observe the command, rewrite it by passing changed copy to next,
+// veto it by returning reply or error without calling next, and observe or replace reply returned by next.
+// Transfer is only started when the reply that goes out is 1xx, so replacing 150 of RETR, STOR or LIST cancels it.
+// Middleware runs before login and transfer checks, so it sees every command of the session.
+// Replies sent when background transfer finishes do not pass through middleware, ReplyHook sees them.
+type Middleware func(next CommandHandler) CommandHandler
+
+// ReplyHook observes every reply sent in response to a command, including replies built from errors
+// and final replies of background transfers (226, 425, 426), which are reported with the command that started the transfer.
+// It is called before the reply is sent, transfer replies are reported from goroutine of the transfer.
+type ReplyHook func(session *SessionInfo, command Command, reply respones.Reply)
+
+// Use adds middleware to command handling of all sessions, it applies to commands received after the call.
+// First added middleware is the outermost one, it sees the command first and the reply last.
+func (server *FtpServer) Use(middleware ...Middleware) {
+	server.extensionsLock.Lock()
+	defer server.extensionsLock.Unlock()
+
+	server.middleware = append(server.middleware, middleware...)
+}
+
+// OnReply adds hooks called for replies of all sessions, they apply to replies sent after the call
+func (server *FtpServer) OnReply(hooks ...ReplyHook) {
+	server.extensionsLock.Lock()
+	defer server.extensionsLock.Unlock()
+
+	server.replyHooks = append(server.replyHooks, hooks...)
+}
+
+// respondTo reports reply of command to reply hooks and sends it
+func (session *SessionInfo) respondTo(command Command, reply respones.Reply) {
+	session.server.extensionsLock.Lock()
+	hooks := session.server.replyHooks
+	session.server.extensionsLock.Unlock()
+
+	for _, hook := range hooks {
+		hook(session, command, reply)
+	}
+
+	session.RespondOrPanic(reply)
+}
+
+// commandHandler returns handler of commands wrapped in registered middleware
+func (server *FtpServer) commandHandler() CommandHandler {
+	server.extensionsLock.Lock()
+	defer server.extensionsLock.Unlock()
+
+	handler := CommandHandler(runCommand)
+	for idx := len(server.middleware) - 1; idx >= 0; idx-- {
+		handler = server.middleware[idx](handler)
+	}
+
+	return handler
+}
@@ -0,0 +1,50 @@
+package ftp
+
+import (
+	"slices"
+	"time"
+)
+
+// presence is copy of session state shown to other sessions, it is only accessed under sessionsLock,
+// because fields of SessionInfo are owned by goroutine of the session
+type presence struct {
+	username      string
+	remoteIP      string
+	connectedAt   time.Time
+	lastCommandAt time.Time
+}
+
+func newPresence(session *SessionInfo) *presence {
+	return &presence{
+		username:      session.username,
+		remoteIP:      session.RemoteIP().String(),
+		connectedAt:   session.startedAt,
+		lastCommandAt: session.lastCommandAt,
+	}
+}
+
+// updatePresence copies state of the session after it handled command
+func (server *FtpServer) updatePresence(session *SessionInfo) {
+	server.sessionsLock.Lock()
+	defer server.sessionsLock.Unlock()
+
+	if _, ok := server.sessions[session]; ok {
+		server.sessions[session] = newPresence(session)
+	}
+}
+
+// presences returns state of all connected sessions, ordered by connection time
+func (server *FtpServer) presences() []presence {
+	server.sessionsLock.Lock()
+	defer server.sessionsLock.Unlock()
+
+	presences := make([]presence, 0, len(server.sessions))
+	for _, sessionPresence := range server.sessions {
+		presences = append(presences, *sessionPresence)
+	}
+	slices.SortFunc(presences, func(a, b presence) int {
+		return a.connectedAt.Compare(b.connectedAt)
+	})
+
+	return presences
+}
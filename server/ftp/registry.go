@@ -0,0 +1,160 @@
+package ftp
+
+import (
+	"fmt"
+	"log"
+	"server/fs"
+	"server/respones"
+	"slices"
+	"strings"
+)
+
+// argumentHandler handles command with its argument, argument is empty when command has none
+type argumentHandler func(session *SessionInfo, argument string) (respones.Reply, error)
+
+// commandSpec describes command, dispatcher checks its requirements before the handler is called
+type commandSpec struct {
+	handler        argumentHandler
+	public         bool                            // allowed before user logs in
+	duringTransfer bool                            // allowed while transfer is running
+	needsArgument  bool                            // command without argument is refused with 501
+	feature        string                          // line listed by FEAT, empty for commands of RFC 959
+	hasFeature     func(session *SessionInfo) bool // feature is only listed when it returns true, nil lists it always
+	help           string                          // syntax shown by HELP <command>
+}
+
+// commands maps upper case command name to its spec, it is filled in init, because HELP and FEAT read it
+var commands map[string]commandSpec
+
+func init() {
+	commands = map[string]commandSpec{
+		"USER": {handler: (*SessionInfo).handleUSER, public: true, needsArgument: true, help: "USER <username>"},
+		"PASS": {handler: (*SessionInfo).handlePASS, public: true, help: "PASS <password>"},
+		// accounts and mounting of other filesystems are not used by this server
+		"ACCT": {handler: withoutArgument((*SessionInfo).handleSuperfluous), public: true, needsArgument: true, help: "ACCT <account>"},
+		"SMNT": {handler: withoutArgument((*SessionInfo).handleSuperfluous), needsArgument: true, help: "SMNT <pathname>"},
+		"REIN": {handler: withoutArgument((*SessionInfo).handleREIN), public: true, help: "REIN"},
+		"QUIT": {handler: withoutArgument((*SessionInfo).handleQUIT), public: true, help: "QUIT"},
+		// keepalive and informational commands do not change session, so they can be answered during transfer
+		"HELP": {handler: (*SessionInfo).handleHELP, public: true, duringTransfer: true, help: "HELP [<command>]"},
+		"NOOP": {handler: withoutArgument((*SessionInfo).handleNOOP), public: true, duringTransfer: true, help: "NOOP"},
+		"SYST": {handler: withoutArgument((*SessionInfo).handleSYST), help: "SYST"},
+		"FEAT": {handler: withoutArgument((*SessionInfo).handleFEAT), public: true, duringTransfer: true, help: "FEAT"},
+		// polling progress must not wait for the transfer
+		"STAT": {handler: (*SessionInfo).handleSTAT, duringTransfer: true, help: "STAT [<pathname>]"},
+		"PWD":  {handler: withoutArgument((*SessionInfo).handlePWD), help: "PWD"},
+		"CWD":  {handler: (*SessionInfo).handleCWD, needsArgument: true, help: "CWD <pathname>"},
+		"TYPE": {handler: (*SessionInfo).handleTYPE, needsArgument: true, help: "TYPE <A|E|I|L 8> [<N|T|C>]"},
+		"STRU": {handler: (*SessionInfo).handleSTRU, needsArgument: true, help: "STRU <F|R|P>"},
+		"MODE": {handler: (*SessionInfo).handleMODE, needsArgument: true, help: "MODE <S|B|C>"},
+		"PASV": {handler: withoutArgument((*SessionInfo).handlePASV), help: "PASV"},
+		"EPSV": {handler: withoutArgument((*SessionInfo).handleEPSV), help: "EPSV"},
+		"PORT": {handler: (*SessionInfo).handlePORT, needsArgument: true, help: "PORT <h1,h2,h3,h4,p1,p2>"},
+		"EPRT": {handler: (*SessionInfo).handleEPRT, needsArgument: true, help: "EPRT |<protocol>|<address>|<port>|"},
+		"LIST": {handler: (*SessionInfo).handleLIST, help: "LIST [<pathname>]"},
+		"RETR": {handler: (*SessionInfo).handleRETR, needsArgument: true, help: "RETR <pathname>"},
+		"STOR": {handler: (*SessionInfo).handleSTOR, needsArgument: true, help: "STOR <pathname>"},
+		"ALLO": {handler: (*SessionInfo).handleALLO, needsArgument: true, help: "ALLO <size> [R <record size>]"},
+		"SIZE": {handler: (*SessionInfo).handleSIZE, needsArgument: true, feature: "SIZE", help: "SIZE <pathname>"},
+		"MDTM": {handler: (*SessionInfo).handleMDTM, needsArgument: true, feature: "MDTM", help: "MDTM [<time-val>] <pathname>"},
+		"MFMT": {handler: (*SessionInfo).handleMFMT, needsArgument: true, feature: "MFMT", hasFeature: (*SessionInfo).canSetModTime, help: "MFMT <time-val> <pathname>"},
+		"REST": {handler: (*SessionInfo).handleREST, needsArgument: true, feature: "REST STREAM", help: "REST <offset>"},
+		"ABOR": {handler: withoutArgument((*SessionInfo).handleABOR), duringTransfer: true, help: "ABOR"},
+		"RNFR": {handler: (*SessionInfo).handleRNFR, needsArgument: true, help: "RNFR <pathname>"},
+		"RNTO": {handler: (*SessionInfo).handleRNTO, needsArgument: true, help: "RNTO <pathname>"},
+		"DELE": {handler: (*SessionInfo).handleDELE, needsArgument: true, help: "DELE <pathname>"},
+		"MKD":  {handler: (*SessionInfo).handleMKD, needsArgument: true, help: "MKD <pathname>"},
+		"SITE": {handler: (*SessionInfo).handleSITE, needsArgument: true, help: "SITE <command> [<arguments>]"},
+		"AUTH": {handler: (*SessionInfo).handleAUTH, public: true, needsArgument: true, feature: "AUTH TLS", hasFeature: (*SessionInfo).canStartTLS, help: "AUTH TLS"},
+		"PBSZ": {handler: (*SessionInfo).handlePBSZ, public: true, needsArgument: true, feature: "PBSZ", hasFeature: (*SessionInfo).hasTLS, help: "PBSZ 0"},
+		"PROT": {handler: (*SessionInfo).handlePROT, public: true, needsArgument: true, feature: "PROT", hasFeature: (*SessionInfo).hasTLS, help: "PROT <C|S|E|P>"},
+	}
+}
+
+// withoutArgument adapts handler of command that has no argument
+func withoutArgument(handler func(session *SessionInfo) (respones.Reply, error)) argumentHandler {
+	return func(session *SessionInfo, _ string) (respones.Reply, error) {
+		return handler(session)
+	}
+}
+
+// parseCommand splits command line to upper case command name and its argument
+func parseCommand(commandLine string) Command {
+	log.Printf("Received command '%s'", commandLine)
+
+	name, argument, _ := strings.Cut(commandLine, " ")
+	return Command{Name: strings.ToUpper(name), Argument: argument}
+}
+
+// dispatchCommand passes the command through middleware to its handler
+func (session *SessionInfo) dispatchCommand(command Command) (respones.Reply, error) {
+	return session.server.commandHandler()(session, command)
+}
+
+// runCommand checks requirements of command and returns reply of its handler, it is the innermost handler of middleware chain
+func runCommand(session *SessionInfo, command Command) (respones.Reply, error) {
+	name, argument := command.Name, command.Argument
+
+	spec, ok := commands[name]
+	if !ok {
+		return respones.Reply{}, NewError(fmt.Sprintf("command %s is not implemented", name), "Command not implemented.", 502, false)
+	}
+
+	if !spec.public && !session.isLoggedIn {
+		return respones.Reply{}, errNotLoggedIn
+	}
+
+	// better way would be to place command in some queue to be processed later
+	if !spec.duringTransfer && session.command.IsRunning() {
+		return respones.Reply{}, newBadSequenceError(fmt.Sprintf("%s received while transfer is running", name))
+	}
+
+	if spec.needsArgument && argument == "" {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("%s without argument", name))
+	}
+
+	return spec.handler(session, argument)
+}
+
+// commandNames returns sorted names of all commands
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// features returns FEAT lines of commands available on this session
+func (session *SessionInfo) features() []string {
+	features := make([]string, 0)
+
+	for _, name := range commandNames() {
+		spec := commands[name]
+		if spec.feature == "" || spec.hasFeature != nil && !spec.hasFeature(session) {
+			continue
+		}
+
+		features = append(features, spec.feature)
+	}
+
+	return features
+}
+
+// hasTLS reports whether server has TLS configuration, so control connection is or can be protected
+func (session *SessionInfo) hasTLS() bool {
+	return session.tlsConfig != nil
+}
+
+// canStartTLS reports whether plain control connection can be protected by AUTH TLS
+func (session *SessionInfo) canStartTLS() bool {
+	return session.hasTLS() && !session.controlConnection.IsTLS()
+}
+
+// canSetModTime reports whether filesystem of the session can change modification time, used by MFMT
+func (session *SessionInfo) canSetModTime() bool {
+	_, ok := session.filesystem.(fs.ModTimeSetter)
+	return ok
+}
@@ -0,0 +1,82 @@
+package ftp
+
+import (
+	"errors"
+	"net"
+	"server/fs"
+	"server/fs/mapedfs"
+	"server/ftp/commandState"
+	"server/ftp/connection"
+	"slices"
+	"testing"
+)
+
+func TestCommandsDuringTransfer(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	session := &SessionInfo{
+		controlConnection: connection.NewConnection(&server, 512, 0),
+		isLoggedIn:        true,
+		command:           commandState.New(),
+	}
+	session.command.Start("RETR file.txt")
+
+	tests := []struct {
+		command Command
+		allowed bool
+	}{
+		{Command{Name: "NOOP"}, true},
+		{Command{Name: "HELP"}, true},
+		{Command{Name: "HELP", Argument: "RETR"}, true},
+		{Command{Name: "FEAT"}, true},
+		{Command{Name: "PWD"}, false},
+		{Command{Name: "CWD", Argument: "/"}, false},
+	}
+
+	for _, test := range tests {
+		_, err := runCommand(session, test.command)
+
+		var serverError *ServerError
+		refused := errors.As(err, &serverError) && serverError.StatusCode() == 503
+		if refused == test.allowed {
+			t.Errorf("%s %s during transfer: error %v", test.command.Name, test.command.Argument, err)
+		}
+	}
+}
+
+// basicFS hides optional capabilities of the wrapped filesystem
+type basicFS struct {
+	fs.Filesystem
+}
+
+func TestFeaturesDependOnFilesystem(t *testing.T) {
+	filesystem, err := mapedfs.CreateFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		filesystem fs.Filesystem
+		mfmt       bool
+	}{
+		{name: "filesystem setting modification time", filesystem: filesystem, mfmt: true},
+		{name: "filesystem without modification time", filesystem: basicFS{filesystem}, mfmt: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := &SessionInfo{filesystem: test.filesystem}
+			features := session.features()
+
+			if slices.Contains(features, "MFMT") != test.mfmt {
+				t.Errorf("features = %v, MFMT listed should be %t", features, test.mfmt)
+			}
+			// reading modification time works on every filesystem
+			if !slices.Contains(features, "MDTM") {
+				t.Errorf("features = %v, MDTM missing", features)
+			}
+		})
+	}
+}
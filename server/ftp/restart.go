@@ -0,0 +1,112 @@
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// errInvalidRestartOffset means that REST offset can not be used with the file
+var errInvalidRestartOffset = errors.New("invalid restart offset")
+
+// statFile returns info of file behind reader, false for readers not backed by real file
+func statFile(reader io.Reader) (os.FileInfo, bool) {
+	file, ok := reader.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return nil, false
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false
+	}
+
+	return info, true
+}
+
+// closeReader closes reader returned by filesystem, if it can be closed
+func closeReader(reader io.Reader) {
+	if closer, ok := reader.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// transferSize returns number of bytes RETR of the file would send in current TYPE
+func (session *SessionInfo) transferSize(path string) (int64, error) {
+	fileReader, err := session.filesystem.Retrieve(path)
+	if err != nil {
+		return 0, err
+	}
+	defer closeReader(fileReader)
+
+	info, ok := statFile(fileReader)
+	if ok && info.IsDir() {
+		return 0, NewError(fmt.Sprintf("%s is a directory", path), "Not a plain file.", 550, false)
+	}
+
+	parameters := session.transferParameters()
+	if ok && !parameters.TranslatesData() {
+		return info.Size(), nil
+	}
+
+	// translated size or size unknown to filesystem needs reading of whole file
+	return parameters.TransferSize(fileReader)
+}
+
+// fileModTime returns modification time of file, filesystems that do not return real files can not report it
+func (session *SessionInfo) fileModTime(path string) (time.Time, error) {
+	fileReader, err := session.filesystem.Retrieve(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer closeReader(fileReader)
+
+	info, ok := statFile(fileReader)
+	if !ok {
+		return time.Time{}, NewError(fmt.Sprintf("modification time of %s is unknown", path), "File modification time not available.", 550, false)
+	}
+	if info.IsDir() {
+		return time.Time{}, NewError(fmt.Sprintf("%s is a directory", path), "Not a plain file.", 550, false)
+	}
+
+	return info.ModTime(), nil
+}
+
+// localRestartOffset converts REST offset, which counts transferred bytes, to offset in the local file
+func (session *SessionInfo) localRestartOffset(path string, offset int64) (int64, error) {
+	parameters := session.transferParameters()
+	if offset == 0 || !parameters.TranslatesData() {
+		return offset, nil
+	}
+
+	// translated data before offset have to be counted from the start of file
+	fileReader, err := session.filesystem.Retrieve(path)
+	if err != nil {
+		return 0, err
+	}
+	defer closeReader(fileReader)
+
+	localOffset, err := parameters.LocalOffset(fileReader, offset)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", errInvalidRestartOffset, err)
+	}
+
+	return localOffset, nil
+}
+
+// skipToOffset moves reader to offset, readers that can not seek are read until offset
+func skipToOffset(reader io.Reader, offset int64) error {
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+
+	skipped, err := io.CopyN(io.Discard, reader, offset)
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: offset %d is after end of file (%d)", errInvalidRestartOffset, offset, skipped)
+	}
+
+	return err
+}
@@ -0,0 +1,122 @@
+package ftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"server/fs/mapedfs"
+	"server/ftp/connection"
+	"strings"
+	"testing"
+)
+
+// newTestSession returns session of stream mode and file structure on filesystem holding file.txt with content
+func newTestSession(t *testing.T, content string, dataType connection.DataType, format connection.DataFormat) *SessionInfo {
+	t.Helper()
+
+	root := t.TempDir()
+	err := os.WriteFile(filepath.Join(root, "file.txt"), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesystem, err := mapedfs.CreateFS(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &SessionInfo{
+		filesystem:       filesystem,
+		dataType:         dataType,
+		dataFormat:       format,
+		transmissionMode: connection.MODE_STREAM,
+		fileStructure:    connection.STRUCTURE_FILE,
+	}
+}
+
+func TestLocalRestartOffset(t *testing.T) {
+	tests := []struct {
+		name     string
+		dataType connection.DataType
+		format   connection.DataFormat
+		offset   int64
+		want     int64
+		invalid  bool
+	}{
+		{name: "image is not translated", dataType: connection.TYPE_IMAGE, offset: 3, want: 3},
+		{name: "ascii after line ending", dataType: connection.TYPE_ASCII, format: connection.FORMAT_NON_PRINT, offset: 5, want: 4},
+		{name: "ascii inside line ending", dataType: connection.TYPE_ASCII, format: connection.FORMAT_NON_PRINT, offset: 4, invalid: true},
+		{name: "ascii after end of file", dataType: connection.TYPE_ASCII, format: connection.FORMAT_NON_PRINT, offset: 100, invalid: true},
+		{name: "zero offset is always accepted", dataType: connection.TYPE_ASCII, format: connection.FORMAT_ASA, offset: 0, want: 0},
+		{name: "asa format can not restart", dataType: connection.TYPE_ASCII, format: connection.FORMAT_ASA, offset: 1, invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := newTestSession(t, "abc\ndef\n", test.dataType, test.format)
+
+			offset, err := session.localRestartOffset("/file.txt", test.offset)
+			if test.invalid {
+				if !errors.Is(err, errInvalidRestartOffset) {
+					t.Errorf("error = %v, want invalid restart offset", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if offset != test.want {
+				t.Errorf("local offset = %d, want %d", offset, test.want)
+			}
+		})
+	}
+}
+
+func TestTransferSize(t *testing.T) {
+	session := newTestSession(t, "abc\ndef\n", connection.TYPE_IMAGE, connection.FORMAT_NON_PRINT)
+
+	size, err := session.transferSize("/file.txt")
+	if err != nil || size != 8 {
+		t.Errorf("image size = %d, %v, want 8", size, err)
+	}
+
+	session.dataType = connection.TYPE_ASCII
+	size, err = session.transferSize("/file.txt")
+	if err != nil || size != 10 {
+		t.Errorf("ascii size = %d, %v, want 10", size, err)
+	}
+}
+
+// nonSeekingReader hides Seek of the underlying reader
+type nonSeekingReader struct {
+	io.Reader
+}
+
+func TestSkipToOffset(t *testing.T) {
+	readers := map[string]func() io.Reader{
+		"seeker":     func() io.Reader { return strings.NewReader("abcdef") },
+		"non seeker": func() io.Reader { return nonSeekingReader{strings.NewReader("abcdef")} },
+	}
+
+	for name, newReader := range readers {
+		t.Run(name, func(t *testing.T) {
+			reader := newReader()
+			err := skipToOffset(reader, 4)
+			if err != nil {
+				t.Fatalf("skipToOffset: %s", err)
+			}
+
+			rest, _ := io.ReadAll(reader)
+			if string(rest) != "ef" {
+				t.Errorf("rest = %q, want \"ef\"", rest)
+			}
+		})
+	}
+
+	err := skipToOffset(nonSeekingReader{strings.NewReader("abc")}, 10)
+	if !errors.Is(err, errInvalidRestartOffset) {
+		t.Errorf("error = %v, want invalid restart offset", err)
+	}
+}
@@ -1,19 +1,148 @@
 package ftp
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"server/ftp/connection"
+	"server/respones"
+	"strings"
+	"sync"
+	"time"
 )
 
+const DEFAULT_DATA_CONNECT_TIMEOUT = 60 * time.Second
+const DEFAULT_DATA_IDLE_TIMEOUT = 300 * time.Second
+const DEFAULT_PASSIVE_LISTENER_LIFETIME = 300 * time.Second
+const DEFAULT_CONTROL_IDLE_TIMEOUT = 300 * time.Second
+const DEFAULT_MAX_COMMAND_LINE_LENGTH = 4096
+const DEFAULT_TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
 type FtpServer struct {
 	controlConnectionListener net.Listener
 	listenAddr                string
 	nextConnectionId          int
 	sessionClosedChannel      chan int
+	settings                  Settings
+	limits                    *sessionLimits
+	bandwidth                 *bandwidthLimiters // shared by all transfers on the server
+	sessionBandwidthLimit     BandwidthLimit     // limit of every single session
+	usersBandwidth            map[string]*bandwidthLimiters
+	sessions                  map[*SessionInfo]*presence
+	sessionsLock              *sync.Mutex // guards sessions, usersBandwidth and sessionBandwidthLimit
+	middleware                []Middleware
+	replyHooks                []ReplyHook
+	siteCommands              map[string]SiteCommand
+	extensionsLock            *sync.Mutex // guards middleware, replyHooks and siteCommands
+}
+
+// Settings configures behaviour of FtpServer
+type Settings struct {
+	// TLSConfig holds server certificate used for FTPS, clients protect plain control connection by AUTH TLS.
+	// nil means that server only talks plain FTP
+	TLSConfig *tls.Config
+	// ImplicitTLS wraps every accepted control connection in TLS before greeting is sent (traditionally port 990),
+	// data connections are then always protected
+	ImplicitTLS bool
+	// RequireTLSSessionReuse rejects protected data connections that do not resume TLS session of control connection,
+	// that way third party connecting to passive port first cannot hijack the transfer
+	RequireTLSSessionReuse bool
+	// ClientCertificates maps TLS client certificates to users,
+	// TLSConfig.ClientAuth has to be set to request certificates from clients
+	ClientCertificates []CertificateMapping
+	// AllowForeignDataConnections accepts passive data connections from any address,
+	// only meant for trusted NAT setups where client data connections come from different address than control connection
+	AllowForeignDataConnections bool
+	// FXPUsers may use PORT and EPRT with address other than their own and accept passive connections
+	// from other addresses (server to server transfers), everybody else can only transfer with control connection peer
+	FXPUsers []string
+	// DataConnectTimeout limits waiting for the client to connect to data port, 0 uses default
+	DataConnectTimeout time.Duration
+	// DataIdleTimeout aborts transfer when no data moved for this long, 0 uses default
+	DataIdleTimeout time.Duration
+	// PassiveListenerLifetime closes passive listener that client did not use, 0 uses default
+	PassiveListenerLifetime time.Duration
+	// ControlIdleTimeout closes session when client sends no command for this long, 0 uses default.
+	// Time of running transfer is not counted. Client that does not read reply for this long is disconnected too.
+	ControlIdleTimeout time.Duration
+	// MaxSessionDuration closes session after this time, running transfer is always finished first. 0 disables it
+	MaxSessionDuration time.Duration
+	// TLSHandshakeTimeout closes implicit FTPS connection that does not finish TLS handshake in time, 0 uses default
+	TLSHandshakeTimeout time.Duration
+	// MaxCommandLineLength refuses longer command lines, 0 uses default
+	MaxCommandLineLength int
+	// MaxSessions limits concurrent sessions of the whole server, 0 means unlimited
+	MaxSessions int
+	// MaxSessionsPerIP limits concurrent sessions from single address, 0 means unlimited
+	MaxSessionsPerIP int
+	// MaxSessionsPerUser limits concurrent sessions of logged in user, 0 means unlimited
+	MaxSessionsPerUser int
+	// BandwidthLimit is shared by all transfers on the server
+	BandwidthLimit BandwidthLimit
+	// UserBandwidthLimits are shared by all sessions of the user, users without entry are not limited
+	UserBandwidthLimits map[string]BandwidthLimit
+	// SessionBandwidthLimit applies to every session separately
+	SessionBandwidthLimit BandwidthLimit
+	// SiteAdmins see sessions of all users in SITE WHO, other users only see their own sessions
+	SiteAdmins []string
+	// EBCDICCodepage is IBM code page used by TYPE E until client chooses other one by SITE CODEPAGE, empty uses default
+	EBCDICCodepage string
+}
+
+// withDefaults fills settings that were not set
+func (settings Settings) withDefaults() Settings {
+	if settings.DataConnectTimeout == 0 {
+		settings.DataConnectTimeout = DEFAULT_DATA_CONNECT_TIMEOUT
+	}
+
+	if settings.DataIdleTimeout == 0 {
+		settings.DataIdleTimeout = DEFAULT_DATA_IDLE_TIMEOUT
+	}
+
+	if settings.PassiveListenerLifetime == 0 {
+		settings.PassiveListenerLifetime = DEFAULT_PASSIVE_LISTENER_LIFETIME
+	}
+
+	if settings.ControlIdleTimeout == 0 {
+		settings.ControlIdleTimeout = DEFAULT_CONTROL_IDLE_TIMEOUT
+	}
+
+	if settings.TLSHandshakeTimeout == 0 {
+		settings.TLSHandshakeTimeout = DEFAULT_TLS_HANDSHAKE_TIMEOUT
+	}
+
+	if settings.MaxCommandLineLength == 0 {
+		settings.MaxCommandLineLength = DEFAULT_MAX_COMMAND_LINE_LENGTH
+	}
+
+	if settings.EBCDICCodepage == "" {
+		settings.EBCDICCodepage = connection.DEFAULT_CODEPAGE
+	}
+
+	return settings
+}
+
+// defaultCodepage returns EBCDIC code page of new sessions, it was validated when server started
+func (server *FtpServer) defaultCodepage() *connection.Codepage {
+	codepage, _ := connection.LookupCodepage(server.settings.EBCDICCodepage)
+	return codepage
 }
 
-func StartFTPServer(listenAddress string) (*FtpServer, error) {
+func StartFTPServer(listenAddress string, settings Settings) (*FtpServer, error) {
+	if settings.ImplicitTLS && settings.TLSConfig == nil {
+		return nil, fmt.Errorf("implicit TLS requires TLSConfig to be set")
+	}
+
+	if settings.RequireTLSSessionReuse && settings.TLSConfig != nil && settings.TLSConfig.SessionTicketsDisabled {
+		return nil, fmt.Errorf("TLS session reuse cannot be required when session tickets are disabled")
+	}
+
+	if _, ok := connection.LookupCodepage(settings.withDefaults().EBCDICCodepage); !ok {
+		return nil, fmt.Errorf("unknown EBCDIC codepage %s, supported are %s", settings.EBCDICCodepage, strings.Join(connection.CodepageNames(), ", "))
+	}
+
 	listener, err := net.Listen("tcp", listenAddress)
 	if err != nil {
 		return nil, fmt.Errorf("listen on %s: %s", listenAddress, err)
@@ -23,6 +152,15 @@ func StartFTPServer(listenAddress string) (*FtpServer, error) {
 		controlConnectionListener: listener,
 		listenAddr:                listenAddress,
 		nextConnectionId:          0,
+		settings:                  settings.withDefaults(),
+		limits:                    newSessionLimits(),
+		bandwidth:                 newBandwidthLimiters(settings.BandwidthLimit),
+		sessionBandwidthLimit:     settings.SessionBandwidthLimit,
+		usersBandwidth:            make(map[string]*bandwidthLimiters),
+		sessions:                  make(map[*SessionInfo]*presence),
+		sessionsLock:              &sync.Mutex{},
+		siteCommands:              standardSiteCommands(),
+		extensionsLock:            &sync.Mutex{},
 	}
 
 	go server.handleConnections()
@@ -44,22 +182,60 @@ func (server *FtpServer) Stop() error {
 func (server *FtpServer) handleConnections() {
 	for {
 		newConnection, err := server.controlConnectionListener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Printf("control connection listener closed, no longer accepting connections")
+			return
+		}
 		if err != nil {
 			log.Printf("error accepting control controlConnection: %s", err)
+			continue
 		}
 
 		log.Printf("new controlConnection accepted from %s", newConnection.RemoteAddr().String())
 
-		session, err := createSession(&newConnection)
-
-		// this is a main thread for tcp sessions
-		go session.Start()
+		// limits are checked before TLS handshake, so clients that never finish it still count
+		remoteIP := connectionIP(newConnection)
+		if !server.limits.acquireConnection(server.settings, remoteIP) {
+			log.Printf("refusing session from %s, too many connections", remoteIP)
+			server.refuseConnection(newConnection)
+			continue
+		}
 
+		session, err := createSession(&newConnection, server)
 		if err != nil {
 			log.Printf("error starting session: %s", err)
+			_ = newConnection.Close()
+			server.limits.releaseConnection(remoteIP)
+			continue
 		}
 
+		// this is a main thread for tcp sessions
+		go func() {
+			defer server.limits.releaseConnection(remoteIP)
+			session.Start()
+		}()
+	}
+}
+
+// connectionIP returns address of the peer, limits per IP are counted by it
+func connectionIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
 	}
+
+	return host
+}
+
+// refuseConnection closes connection over limits, plain connection gets 421 first,
+// implicit FTPS client is not worth a TLS handshake
+func (server *FtpServer) refuseConnection(conn net.Conn) {
+	if !server.settings.ImplicitTLS {
+		_ = conn.SetWriteDeadline(time.Now().Add(server.settings.TLSHandshakeTimeout))
+		_, _ = conn.Write([]byte(respones.TooManyConnections().String() + "\r\n"))
+	}
+
+	_ = conn.Close()
 }
 
 func (server *FtpServer) getSessionId() int {
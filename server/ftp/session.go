@@ -1,14 +1,21 @@
 package ftp
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"os"
 	"server/fs"
 	"server/fs/mapedfs"
 	"server/ftp/commandState"
 	"server/ftp/connection"
 	"server/respones"
 	"server/sequences"
+	"slices"
+	"time"
 )
 
 type SessionInfo struct {
@@ -21,19 +28,46 @@ type SessionInfo struct {
 	dataType          connection.DataType
 	dataFormat        connection.DataFormat
 	transmissionMode  connection.TransmissionMode
+	fileStructure     connection.FileStructure
+	codepage          *connection.Codepage // EBCDIC code page used by TYPE E
+	restartOffset     int64                // set by REST, used by next RETR
+	pendingTransfer   *pendingTransfer     // transfer prepared by command, it is started after the command reply
+	transferCommand   Command              // command that started the last transfer, replies finishing it are reported with it
 	filesystem        fs.Filesystem
 	command           *commandState.CommandState
+	server            *FtpServer
+	tlsConfig         *tls.Config // per session clone of server TLS config, shared by control and data connections
+	startTLS          bool        // set by AUTH TLS, control connection is protected after its reply
+	protectData       bool        // PROT P, implicit FTPS always protects data connections
+	startedAt         time.Time
+	lastCommandAt     time.Time
+	idleTimeout       time.Duration // ControlIdleTimeout of the server, client can shorten it by SITE IDLE
+	bandwidth         *bandwidthLimiters
 }
 
-func createSession(controlConnection *net.Conn) (*SessionInfo, error) {
+func createSession(controlConnection *net.Conn, server *FtpServer) (*SessionInfo, error) {
 	// create fs
 	filesystem, err := mapedfs.CreateFS("/home/jrada/git/simple-ftp/test-fs")
 	if err != nil {
 		return nil, err
 	}
 
+	var tlsConfig *tls.Config
+	if server.settings.TLSConfig != nil {
+		tlsConfig, err = newSessionTLSConfig(server.settings.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// in implicit mode, whole control connection is protected, handshake is done before greeting
+	if server.settings.ImplicitTLS {
+		var tlsConnection net.Conn = tls.Server(*controlConnection, tlsConfig)
+		controlConnection = &tlsConnection
+	}
+
 	session := &SessionInfo{
-		controlConnection: connection.NewConnection(controlConnection),
+		controlConnection: connection.NewConnection(controlConnection, server.settings.MaxCommandLineLength, server.settings.ControlIdleTimeout),
 		dataConnection:    nil,
 		cwd:               "/",
 		isLoggedIn:        false,
@@ -42,8 +76,16 @@ func createSession(controlConnection *net.Conn) (*SessionInfo, error) {
 		dataType:          connection.TYPE_ASCII,
 		dataFormat:        connection.FORMAT_NON_PRINT,
 		transmissionMode:  connection.MODE_STREAM,
+		fileStructure:     connection.STRUCTURE_FILE,
+		codepage:          server.defaultCodepage(),
 		filesystem:        filesystem,
 		command:           commandState.New(),
+		server:            server,
+		tlsConfig:         tlsConfig,
+		protectData:       server.settings.ImplicitTLS,
+		startedAt:         time.Now(),
+		lastCommandAt:     time.Now(),
+		idleTimeout:       server.settings.ControlIdleTimeout,
 	}
 
 	return session, nil
@@ -58,51 +100,321 @@ func (session *SessionInfo) Start() {
 			log.Println("PANIC: panic occurred in session :", err)
 		}
 
+		// stop running transfer, it would otherwise keep going after session ended
+		session.command.Abort()
+
 		// ensure the connection are closed
 		_ = session.controlConnection.Close()
-		_ = session.dataConnection.Close()
+		_ = session.dataConnection.Release()
+
+		if session.isLoggedIn {
+			session.server.limits.releaseUser(session.username)
+		}
 	}()
 
 	log.Printf("session is starting...")
 
+	// greeting can only be sent after client completes TLS handshake on implicit FTPS connection
+	err := session.controlConnection.Handshake(session.server.settings.TLSHandshakeTimeout)
+	if err != nil {
+		log.Printf("TLS handshake on control connection failed: %s", err)
+		return
+	}
+
+	session.server.registerSession(session)
+	defer session.server.unregisterSession(session)
+
 	session.RespondOrPanic(respones.ServerReady())
 
 	for {
+		err = session.controlConnection.SetReadDeadline(session.readDeadline())
+		if err != nil {
+			log.Printf("Error setting deadline on control connection: %s", err)
+			break
+		}
+
 		line, err := session.controlConnection.ReceiveLine()
 
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if session.hasExpired() {
+				break
+			}
+			continue
+		}
+
+		if errors.Is(err, connection.ErrLineTooLong) {
+			log.Printf("command line exceeded %d bytes", session.server.settings.MaxCommandLineLength)
+			session.RespondOrPanic(respones.LineTooLong())
+			continue
+		}
+
 		if err != nil {
 			log.Printf("Error reading line from control controlConnection: %s", err)
 			break
 
 		}
 
+		session.lastCommandAt = time.Now()
+
 		// maybe handle if not response have been send
 		err = session.handleCommand(line)
+		session.server.updatePresence(session)
 		if err != nil {
-			log.Printf("error while handling command")
+			log.Printf("closing session: %s", err)
 			break
 		}
 
 	}
 }
 
+// login marks user as logged in, returned error closes the session when user has too many sessions
+func (session *SessionInfo) login(username string) error {
+	if session.isLoggedIn {
+		session.server.limits.releaseUser(session.username)
+		session.isLoggedIn = false
+	}
+
+	if !session.server.limits.acquireUser(session.server.settings, username) {
+		return NewError(fmt.Sprintf("user %s has too many sessions", username), "Too many connections", 421, true)
+	}
+
+	session.username = username
+	session.isLoggedIn = true
+	session.commandSequence = nil
+
+	return nil
+}
+
+// readDeadline returns time when waiting for next command times out.
+// While transfer is running, timers are paused and the deadline only serves to recheck them later.
+func (session *SessionInfo) readDeadline() time.Time {
+	now := time.Now()
+	if session.command.IsRunning() {
+		return now.Add(session.idleTimeout)
+	}
+
+	// finished transfer counts as activity
+	lastActivity := session.lastCommandAt
+	if finishedAt := session.command.FinishedAt(); finishedAt.After(lastActivity) {
+		lastActivity = finishedAt
+	}
+
+	deadline := lastActivity.Add(session.idleTimeout)
+
+	maxDuration := session.server.settings.MaxSessionDuration
+	if maxDuration > 0 && session.startedAt.Add(maxDuration).Before(deadline) {
+		deadline = session.startedAt.Add(maxDuration)
+	}
+
+	return deadline
+}
+
+// hasExpired is called when read deadline is reached, it notifies client if session should be closed
+func (session *SessionInfo) hasExpired() bool {
+	if session.command.IsRunning() {
+		return false
+	}
+
+	now := time.Now()
+
+	maxDuration := session.server.settings.MaxSessionDuration
+	if maxDuration > 0 && now.Sub(session.startedAt) >= maxDuration {
+		log.Printf("session reached maximum duration %s", maxDuration)
+		session.RespondOrPanic(respones.SessionExpired())
+		return true
+	}
+
+	if !now.Before(session.readDeadline()) {
+		log.Printf("session idle for %s, closing", session.idleTimeout)
+		session.RespondOrPanic(respones.IdleTimeout())
+		return true
+	}
+
+	return false
+}
+
+// Username returns name of the user, it is empty until USER command
+func (session *SessionInfo) Username() string {
+	return session.username
+}
+
+// IsLoggedIn reports whether user of the session was authenticated
+func (session *SessionInfo) IsLoggedIn() bool {
+	return session.isLoggedIn
+}
+
+// RemoteIP returns address of the client
+func (session *SessionInfo) RemoteIP() net.IP {
+	return session.controlConnection.RemoteIP()
+}
+
+// WorkingDirectory returns current directory of the session
+func (session *SessionInfo) WorkingDirectory() string {
+	return session.cwd
+}
+
 // Abort about session is case of server shutdown
 func (session *SessionInfo) Abort() {
 
 	// TODO send abort message
 }
 
-// Respond send response on control controlConnection. Adds newline.
-func (session *SessionInfo) Respond(message string) error {
+// reinitialize logs user out and restores settings of newly connected session, TLS of control connection is kept
+func (session *SessionInfo) reinitialize() {
+	session.replaceDataConnection(nil)
+
+	if session.isLoggedIn {
+		session.server.limits.releaseUser(session.username)
+	}
+
+	session.isLoggedIn = false
+	session.username = ""
+	session.commandSequence = nil
+	session.cwd = "/"
+	session.dataType = connection.TYPE_ASCII
+	session.dataFormat = connection.FORMAT_NON_PRINT
+	session.transmissionMode = connection.MODE_STREAM
+	session.fileStructure = connection.STRUCTURE_FILE
+	session.restartOffset = 0
+	session.codepage = session.server.defaultCodepage()
+	session.idleTimeout = session.server.settings.ControlIdleTimeout
+
+	log.Printf("session reinitialized")
+}
+
+// transferParameters returns representation of data set by TYPE, MODE and STRU
+func (session *SessionInfo) transferParameters() connection.TransferParameters {
+	return connection.TransferParameters{
+		Type:      session.dataType,
+		Format:    session.dataFormat,
+		Codepage:  session.codepage,
+		Mode:      session.transmissionMode,
+		Structure: session.fileStructure,
+	}
+}
+
+// replaceDataConnection switches session to new data connection, listener of the previous one is closed
+func (session *SessionInfo) replaceDataConnection(dataConnection *connection.DataConnection) {
+	err := session.dataConnection.Release()
+	if err != nil {
+		log.Printf("error releasing previous data connection: %s", err)
+	}
+
+	session.dataConnection = dataConnection
+}
+
+// pendingTransfer is transfer prepared by command, which waits for the command reply
+type pendingTransfer struct {
+	description string
+	transfer    func(ctx context.Context) respones.Reply
+	discard     func() // releases resources of transfer that is not started, can be nil
+}
+
+// runTransfer prepares transfer, which runs in background after reply of the command is sent,
+// so control connection can process ABOR in the meantime.
+// transfer returns its final reply, which is not sent when transfer was aborted.
+// description is reported by STAT while transfer runs. discard is called instead of transfer
+// when the command fails or its reply does not announce the transfer, it can be nil.
+func (session *SessionInfo) runTransfer(description string, transfer func(ctx context.Context) respones.Reply, discard func()) {
+	session.pendingTransfer = &pendingTransfer{description: description, transfer: transfer, discard: discard}
+}
+
+// startPendingTransfer starts transfer prepared by command, only reply 1xx tells client that the transfer starts,
+// otherwise the transfer is discarded
+func (session *SessionInfo) startPendingTransfer(command Command, reply respones.Reply) {
+	pending := session.pendingTransfer
+	session.pendingTransfer = nil
+	if pending == nil {
+		return
+	}
+
+	if reply.Code/100 != 1 {
+		log.Printf("discarding transfer of %s, reply %d does not start it", command.Name, reply.Code)
+		if pending.discard != nil {
+			pending.discard()
+		}
+		return
+	}
+
+	session.startTransfer(command, pending.description, pending.transfer)
+}
+
+// startPendingTLS protects control connection when AUTH TLS was accepted by 234 reply,
+// client that fails the handshake can not continue in plain text, so error closes the session
+func (session *SessionInfo) startPendingTLS(reply respones.Reply) error {
+	if !session.startTLS {
+		return nil
+	}
+	session.startTLS = false
+
+	if reply.Code != 234 {
+		return nil
+	}
+
+	return session.controlConnection.StartTLS(session.tlsConfig, session.server.settings.TLSHandshakeTimeout)
+}
+
+func (session *SessionInfo) startTransfer(command Command, description string, transfer func(ctx context.Context) respones.Reply) {
+	ctx := session.command.Start(description)
+	session.transferCommand = command
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("PANIC: runing goroutine for transfer: %s", err)
+			}
+			log.Printf("async task defer")
+			session.command.Finish()
+		}()
+
+		reply := transfer(ctx)
+
+		// replies to aborted transfer are sent by ABOR
+		if !session.command.Complete() {
+			log.Printf("transfer aborted")
+			return
+		}
+
+		session.respondTo(command, reply)
+	}()
+}
+
+// dataConnectionSettings returns settings for new data connection of this session
+func (session *SessionInfo) dataConnectionSettings() connection.DataConnectionSettings {
+	settings := connection.DataConnectionSettings{
+		ConnectTimeout:   session.server.settings.DataConnectTimeout,
+		IdleTimeout:      session.server.settings.DataIdleTimeout,
+		ListenerLifetime: session.server.settings.PassiveListenerLifetime,
+	}
+
+	// in FXP the other server connects to our passive port, so its address can not be checked
+	fxpUser := slices.Contains(session.server.settings.FXPUsers, session.username)
+	if !session.server.settings.AllowForeignDataConnections && !fxpUser {
+		settings.ClientIP = session.controlConnection.RemoteIP()
+	}
+
+	if session.protectData {
+		settings.TLSConfig = session.tlsConfig
+		settings.RequireTLSSessionReuse = session.server.settings.RequireTLSSessionReuse
+		settings.HandshakeTimeout = session.server.settings.TLSHandshakeTimeout
+	}
+
+	return settings
+}
+
+// Respond send reply on control controlConnection. Adds newline.
+func (session *SessionInfo) Respond(reply respones.Reply) error {
+	message := reply.String()
+
 	log.Printf("Server response: %s", message)
 	return session.controlConnection.SendString(message + "\r\n")
 
 }
 
 // RespondOrPanic wrapper around Respond that panics on error, because it is unrecoverable error
-func (session *SessionInfo) RespondOrPanic(message string) {
+func (session *SessionInfo) RespondOrPanic(reply respones.Reply) {
 
-	err := session.Respond(message)
+	err := session.Respond(reply)
 	if err != nil {
 		log.Printf("PANIC: error while responding to client: %s", err)
 		panic(err)
@@ -0,0 +1,243 @@
+package ftp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"server/fs"
+	"server/ftp/connection"
+	"server/respones"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SiteHandler handles SITE command, argument is the rest of command line after the SITE command name
+type SiteHandler func(session *SessionInfo, argument string) (respones.Reply, error)
+
+// SiteCommand describes server specific command run by SITE <name> [<arguments>]
+type SiteCommand struct {
+	Handler       SiteHandler
+	Help          string // syntax shown by SITE HELP
+	NeedsArgument bool   // command without argument is refused with 501
+}
+
+// standardSiteCommands returns SITE commands available on every server
+func standardSiteCommands() map[string]SiteCommand {
+	return map[string]SiteCommand{
+		"CODEPAGE": {Handler: (*SessionInfo).handleSITECodepage, Help: "CODEPAGE [<codepage>]"},
+		"CHMOD":    {Handler: (*SessionInfo).handleSITEChmod, Help: "CHMOD <mode> <pathname>", NeedsArgument: true},
+		"UTIME":    {Handler: (*SessionInfo).handleSITEUtime, Help: "UTIME <YYYYMMDDhhmmss> <pathname>", NeedsArgument: true},
+		"SYMLINK":  {Handler: (*SessionInfo).handleSITESymlink, Help: "SYMLINK <target> <link>", NeedsArgument: true},
+		"WHO":      {Handler: (*SessionInfo).handleSITEWho, Help: "WHO"},
+		"IDLE":     {Handler: (*SessionInfo).handleSITEIdle, Help: "IDLE [<seconds>]"},
+	}
+}
+
+// RegisterSiteCommand adds SITE command to all sessions, name is case-insensitive.
+// Command registered under name of standard command replaces it.
+func (server *FtpServer) RegisterSiteCommand(name string, command SiteCommand) {
+	server.extensionsLock.Lock()
+	defer server.extensionsLock.Unlock()
+
+	server.siteCommands[strings.ToUpper(name)] = command
+}
+
+// siteCommand returns SITE command registered under upper case name
+func (server *FtpServer) siteCommand(name string) (SiteCommand, bool) {
+	server.extensionsLock.Lock()
+	defer server.extensionsLock.Unlock()
+
+	command, ok := server.siteCommands[name]
+	return command, ok
+}
+
+// siteHelp returns sorted syntax of all SITE commands
+func (server *FtpServer) siteHelp() []string {
+	server.extensionsLock.Lock()
+	defer server.extensionsLock.Unlock()
+
+	help := make([]string, 0, len(server.siteCommands))
+	for name, command := range server.siteCommands {
+		if command.Help == "" {
+			command.Help = name
+		}
+		help = append(help, command.Help)
+	}
+	slices.Sort(help)
+
+	return help
+}
+
+// handleSITE dispatches SITE command to the registered handler, SITE HELP lists them
+func (session *SessionInfo) handleSITE(argument string) (respones.Reply, error) {
+	name, parameters, _ := strings.Cut(argument, " ")
+	name = strings.ToUpper(name)
+
+	if name == "HELP" {
+		return respones.SiteHelp(session.server.siteHelp()), nil
+	}
+
+	command, ok := session.server.siteCommand(name)
+	if !ok {
+		return respones.Reply{}, NewError(fmt.Sprintf("SITE command %s is not implemented", name), "Command not implemented.", 502, false)
+	}
+
+	if command.NeedsArgument && parameters == "" {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("SITE %s without argument", name))
+	}
+
+	return command.Handler(session, parameters)
+}
+
+// handleSITECodepage chooses EBCDIC code page of the session, without argument current one is reported
+func (session *SessionInfo) handleSITECodepage(name string) (respones.Reply, error) {
+	if name == "" {
+		return respones.Codepage(session.codepage.Name), nil
+	}
+
+	codepage, ok := connection.LookupCodepage(name)
+	if !ok {
+		supported := strings.Join(connection.CodepageNames(), ", ")
+		return respones.Reply{}, NewError(fmt.Sprintf("unknown codepage %s requested", name), fmt.Sprintf("Unknown codepage, supported are %s.", supported), 504, false)
+	}
+
+	session.codepage = codepage
+	return respones.Codepage(codepage.Name), nil
+}
+
+// handleSITEChmod sets permission bits given as octal number, "<mode> <pathname>"
+func (session *SessionInfo) handleSITEChmod(argument string) (respones.Reply, error) {
+	mode, requestedPath, _ := strings.Cut(argument, " ")
+	if requestedPath == "" {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("SITE CHMOD without pathname: %s", argument))
+	}
+
+	permissions, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || permissions > 0777 {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid SITE CHMOD mode %s", mode))
+	}
+
+	permissionChanger, ok := session.filesystem.(fs.PermissionChanger)
+	if !ok {
+		return respones.Reply{}, newUnsupportedSiteError("CHMOD")
+	}
+
+	joinedPath := filepath.Join(session.cwd, requestedPath)
+	err = permissionChanger.Chmod(joinedPath, os.FileMode(permissions))
+	if err != nil {
+		return respones.Reply{}, newFileError(requestedPath, err)
+	}
+
+	return respones.SiteCommandOkay("CHMOD"), nil
+}
+
+// handleSITEUtime sets modification time of file, both "<time> <pathname>"
+// and "<pathname> <access time> <modification time> <creation time> UTC" forms are accepted
+func (session *SessionInfo) handleSITEUtime(argument string) (respones.Reply, error) {
+	timeValue, requestedPath, err := parseUtimeArgument(argument)
+	if err != nil {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid SITE UTIME argument %s", argument)).wrap(err)
+	}
+
+	modTime, err := time.ParseInLocation(TIME_VAL_FORMAT, timeValue, time.UTC)
+	if err != nil {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid SITE UTIME time %s", timeValue)).wrap(err)
+	}
+
+	err = session.setModTime(requestedPath, modTime)
+	if err != nil {
+		return respones.Reply{}, err
+	}
+
+	return respones.SiteCommandOkay("UTIME"), nil
+}
+
+// parseUtimeArgument returns modification time and path of SITE UTIME argument
+func parseUtimeArgument(argument string) (string, string, error) {
+	fields := strings.Fields(argument)
+
+	// long form used by some clients, pathname can not contain spaces
+	if len(fields) == 5 && strings.EqualFold(fields[4], "UTC") {
+		return fields[2], fields[0], nil
+	}
+
+	timeValue, requestedPath, _ := strings.Cut(argument, " ")
+	if requestedPath == "" {
+		return "", "", fmt.Errorf("expected <time> <pathname>")
+	}
+
+	return timeValue, requestedPath, nil
+}
+
+// handleSITESymlink creates symbolic link, "<target> <link>"
+func (session *SessionInfo) handleSITESymlink(argument string) (respones.Reply, error) {
+	fields := strings.Fields(argument)
+	if len(fields) != 2 {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid SITE SYMLINK argument %s", argument))
+	}
+	target, link := fields[0], fields[1]
+
+	symlinker, ok := session.filesystem.(fs.Symlinker)
+	if !ok {
+		return respones.Reply{}, newUnsupportedSiteError("SYMLINK")
+	}
+
+	err := symlinker.Symlink(filepath.Join(session.cwd, target), filepath.Join(session.cwd, link))
+	if err != nil {
+		return respones.Reply{}, newStoreError(link, err)
+	}
+
+	return respones.SiteCommandOkay("SYMLINK"), nil
+}
+
+// handleSITEWho lists connected sessions, names and addresses of other users are only shown to site admins
+func (session *SessionInfo) handleSITEWho(_ string) (respones.Reply, error) {
+	now := time.Now()
+	lines := make([]string, 0)
+	admin := slices.Contains(session.server.settings.SiteAdmins, session.username)
+
+	for _, sessionPresence := range session.server.presences() {
+		if !admin && sessionPresence.username != session.username {
+			continue
+		}
+
+		username := sessionPresence.username
+		if username == "" {
+			username = "-"
+		}
+
+		connected := now.Sub(sessionPresence.connectedAt).Truncate(time.Second)
+		idle := now.Sub(sessionPresence.lastCommandAt).Truncate(time.Second)
+		lines = append(lines, fmt.Sprintf("%s %s connected %s idle %s", username, sessionPresence.remoteIP, connected, idle))
+	}
+
+	return respones.Who(lines), nil
+}
+
+// handleSITEIdle shows or shortens idle timeout of the session, it can not exceed timeout of the server
+func (session *SessionInfo) handleSITEIdle(argument string) (respones.Reply, error) {
+	maxTimeout := session.server.settings.ControlIdleTimeout
+	if argument == "" {
+		return respones.IdleTime(int(session.idleTimeout.Seconds()), int(maxTimeout.Seconds())), nil
+	}
+
+	seconds, err := strconv.Atoi(argument)
+	if err != nil || seconds <= 0 {
+		return respones.Reply{}, newSyntaxError(fmt.Sprintf("invalid SITE IDLE argument %s", argument))
+	}
+
+	timeout := time.Duration(seconds) * time.Second
+	if timeout > maxTimeout {
+		return respones.Reply{}, NewError(fmt.Sprintf("SITE IDLE %d exceeds maximum %s", seconds, maxTimeout), fmt.Sprintf("Maximum idle time is %d seconds.", int(maxTimeout.Seconds())), 504, false)
+	}
+
+	session.idleTimeout = timeout
+	return respones.IdleTimeSet(seconds), nil
+}
+
+// newUnsupportedSiteError is returned when filesystem of the session lacks capability needed by SITE command
+func newUnsupportedSiteError(name string) *ServerError {
+	return NewError(fmt.Sprintf("filesystem does not support SITE %s", name), "Command not implemented.", 502, false)
+}
@@ -0,0 +1,179 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const MAX_CHUNK_SIZE = 32 * 1024
+const MIN_CHUNK_SIZE = 512
+
+// Limiter is token bucket limiting bytes per second. One limiter can be shared by many transfers,
+// every transfer reserves small chunks in turns, so the bandwidth is split fairly between them.
+type Limiter struct {
+	lock   *sync.Mutex
+	rate   int64     // bytes per second, 0 means unlimited
+	tokens float64   // can be negative, when reservations were made in advance
+	last   time.Time // last time tokens were refilled
+}
+
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	return &Limiter{lock: &sync.Mutex{}, rate: bytesPerSecond, last: time.Now()}
+}
+
+// SetRate changes limit, it applies to running transfers from their next chunk
+func (limiter *Limiter) SetRate(bytesPerSecond int64) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	limiter.refill(time.Now())
+	limiter.rate = bytesPerSecond
+	// allowed burst depends on rate
+	limiter.tokens = min(limiter.tokens, float64(bytesPerSecond))
+	// debt made at old rate would stall transfers for long time at much lower rate,
+	// so at most one chunk of the new rate is kept
+	if bytesPerSecond > 0 {
+		limiter.tokens = max(limiter.tokens, -float64(rateChunkSize(bytesPerSecond)))
+	}
+}
+
+func (limiter *Limiter) Rate() int64 {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	return limiter.rate
+}
+
+// reserve takes size tokens and returns how long caller has to wait before it can use them
+func (limiter *Limiter) reserve(size int) time.Duration {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if limiter.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	limiter.refill(now)
+	limiter.tokens -= float64(size)
+
+	if limiter.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-limiter.tokens / float64(limiter.rate) * float64(time.Second))
+}
+
+// refill adds tokens for time elapsed since last refill, bucket holds at most one second of data
+func (limiter *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(limiter.last)
+	limiter.last = now
+
+	if limiter.rate <= 0 {
+		limiter.tokens = 0
+		return
+	}
+
+	limiter.tokens = min(limiter.tokens+elapsed.Seconds()*float64(limiter.rate), float64(limiter.rate))
+}
+
+// chunkSize returns size of chunk reserved at once, slow limits use smaller chunks,
+// so the transfer stays smooth and reacts quickly to rate changes
+func chunkSize(limiters []*Limiter) int {
+	size := MAX_CHUNK_SIZE
+
+	for _, limiter := range limiters {
+		rate := limiter.Rate()
+		if rate > 0 {
+			size = min(size, rateChunkSize(rate))
+		}
+	}
+
+	return size
+}
+
+// rateChunkSize returns chunk size for single limit, about tenth of second of data
+func rateChunkSize(rate int64) int {
+	return int(min(max(rate/10, MIN_CHUNK_SIZE), MAX_CHUNK_SIZE))
+}
+
+// wait blocks until size bytes can be transferred by all limiters, it returns error of ctx when it is canceled first
+func wait(ctx context.Context, limiters []*Limiter, size int) error {
+	var delay time.Duration
+
+	for _, limiter := range limiters {
+		delay = max(delay, limiter.reserve(size))
+	}
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type reader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*Limiter
+}
+
+// NewReader limits reading from source by all limiters, waiting for bandwidth ends when ctx is canceled
+func NewReader(ctx context.Context, source io.Reader, limiters ...*Limiter) io.Reader {
+	return &reader{ctx: ctx, reader: source, limiters: limiters}
+}
+
+func (throttled *reader) Read(data []byte) (int, error) {
+	size := min(len(data), chunkSize(throttled.limiters))
+
+	n, err := throttled.reader.Read(data[:size])
+	if n > 0 {
+		waitErr := wait(throttled.ctx, throttled.limiters, n)
+		if waitErr != nil {
+			return 0, waitErr
+		}
+	}
+
+	return n, err
+}
+
+type writer struct {
+	ctx      context.Context
+	writer   io.Writer
+	limiters []*Limiter
+}
+
+// NewWriter limits writing to destination by all limiters, waiting for bandwidth ends when ctx is canceled
+func NewWriter(ctx context.Context, destination io.Writer, limiters ...*Limiter) io.Writer {
+	return &writer{ctx: ctx, writer: destination, limiters: limiters}
+}
+
+func (throttled *writer) Write(data []byte) (int, error) {
+	written := 0
+
+	for written < len(data) {
+		size := min(len(data)-written, chunkSize(throttled.limiters))
+		err := wait(throttled.ctx, throttled.limiters, size)
+		if err != nil {
+			return written, err
+		}
+
+		n, err := throttled.writer.Write(data[written : written+size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,47 @@
+package ftp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"slices"
+)
+
+const SESSION_TOKEN_SIZE = 16
+
+// newSessionTLSConfig clones server TLS config for single session.
+// Session tickets issued by this config are tagged with random session token,
+// tickets without the token are not accepted for resumption. Because of that,
+// resumed data connection proves that the client holds TLS session of this control connection.
+// Control and data connections of one session have to use the same config, so they share ticket keys.
+func newSessionTLSConfig(base *tls.Config) (*tls.Config, error) {
+	token := make([]byte, SESSION_TOKEN_SIZE)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, fmt.Errorf("generating TLS session token: %s", err)
+	}
+
+	config := base.Clone()
+
+	config.WrapSession = func(state tls.ConnectionState, sessionState *tls.SessionState) ([]byte, error) {
+		sessionState.Extra = append(sessionState.Extra, token)
+		return config.EncryptTicket(state, sessionState)
+	}
+
+	config.UnwrapSession = func(identity []byte, state tls.ConnectionState) (*tls.SessionState, error) {
+		sessionState, err := config.DecryptTicket(identity, state)
+		if err != nil || sessionState == nil {
+			return sessionState, err
+		}
+
+		// ticket belongs to another session, fall back to full handshake
+		if !slices.ContainsFunc(sessionState.Extra, func(extra []byte) bool { return bytes.Equal(extra, token) }) {
+			return nil, nil
+		}
+
+		return sessionState, nil
+	}
+
+	return config, nil
+}
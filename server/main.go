@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"os"
 	"os/signal"
@@ -9,6 +10,7 @@ import (
 )
 
 const address = ":21"
+const implicitTLSAddress = ":990"
 
 func main() {
 	cancelChan := make(chan os.Signal, 1)
@@ -17,13 +19,43 @@ func main() {
 
 	log.Print("Simple ftp server")
 	log.Print("Starting...")
-	_, err := ftp.StartFTPServer(address)
+	_, err := ftp.StartFTPServer(address, ftp.Settings{})
 	log.Printf("Server is ready to accept connection on %s",
 		address)
 	if err != nil {
 		log.Printf("Error starting ftp server: %s", err)
 	}
 
+	// implicit FTPS listener is only started when certificate is provided
+	certFile := os.Getenv("FTP_TLS_CERT")
+	keyFile := os.Getenv("FTP_TLS_KEY")
+	if certFile != "" && keyFile != "" {
+		startImplicitTLSServer(certFile, keyFile)
+	}
+
 	sig := <-cancelChan
 	log.Printf("Caught signal %v", sig)
 }
+
+func startImplicitTLSServer(certFile string, keyFile string) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Printf("Error loading TLS certificate: %s", err)
+		return
+	}
+
+	settings := ftp.Settings{
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{certificate}},
+		ImplicitTLS: true,
+		// same default as vsftpd require_ssl_reuse
+		RequireTLSSessionReuse: true,
+	}
+
+	_, err = ftp.StartFTPServer(implicitTLSAddress, settings)
+	if err != nil {
+		log.Printf("Error starting implicit FTPS server: %s", err)
+		return
+	}
+
+	log.Printf("Implicit FTPS server is ready to accept connection on %s", implicitTLSAddress)
+}
@@ -0,0 +1,68 @@
+package respones
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Reply is server reply to command, text of the reply can have more lines
+type Reply struct {
+	Code  int
+	Lines []string
+}
+
+func NewReply(code int, lines ...string) Reply {
+	return Reply{Code: code, Lines: lines}
+}
+
+// NewMultilineReply creates reply with text lines between first and last line
+func NewMultilineReply(code int, firstLine string, lines []string, lastLine string) Reply {
+	replyLines := make([]string, 0, len(lines)+2)
+	replyLines = append(replyLines, firstLine)
+	replyLines = append(replyLines, lines...)
+	replyLines = append(replyLines, lastLine)
+
+	return NewReply(code, replyLines...)
+}
+
+// line breaks inside text would end the reply early, so they are replaced
+var lineBreakReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// String formats reply according to RFC 959. Reply with more lines starts with "code-" and ends with "code ",
+// lines between them are indented when they start with digit, so they can not be mistaken for the last line.
+// Lines are separated by CRLF, the last one is not terminated.
+func (reply Reply) String() string {
+	if len(reply.Lines) == 0 {
+		return fmt.Sprintf("%d ", reply.Code)
+	}
+
+	var builder strings.Builder
+	last := len(reply.Lines) - 1
+
+	for idx, line := range reply.Lines {
+		line = lineBreakReplacer.Replace(line)
+
+		switch {
+		case idx == last:
+			builder.WriteString(fmt.Sprintf("%d %s", reply.Code, line))
+		case idx == 0:
+			builder.WriteString(fmt.Sprintf("%d-%s\r\n", reply.Code, line))
+		case line != "" && line[0] >= '0' && line[0] <= '9':
+			builder.WriteString(" " + line + "\r\n")
+		default:
+			builder.WriteString(line + "\r\n")
+		}
+	}
+
+	return builder.String()
+}
+
+// indent prefixes lines with space, text lines of multi-line replies are usually indented
+func indent(lines []string) []string {
+	indented := make([]string, len(lines))
+	for idx, line := range lines {
+		indented[idx] = " " + line
+	}
+
+	return indented
+}
@@ -0,0 +1,71 @@
+package respones
+
+import "testing"
+
+func TestReplyString(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply Reply
+		want  string
+	}{
+		{
+			name:  "single line",
+			reply: NewReply(200, "Command okay."),
+			want:  "200 Command okay.",
+		},
+		{
+			name:  "empty reply",
+			reply: NewReply(200),
+			want:  "200 ",
+		},
+		{
+			name:  "multiple lines",
+			reply: NewReply(211, "Features:", " SIZE", "End"),
+			want:  "211-Features:\r\n SIZE\r\n211 End",
+		},
+		{
+			name:  "two lines",
+			reply: NewReply(214, "Help follows.", "End"),
+			want:  "214-Help follows.\r\n214 End",
+		},
+		{
+			name:  "middle line starting with digits is indented",
+			reply: NewReply(211, "Status:", "211 bytes transferred", "End"),
+			want:  "211-Status:\r\n 211 bytes transferred\r\n211 End",
+		},
+		{
+			name:  "empty middle line",
+			reply: NewReply(211, "Status:", "", "End"),
+			want:  "211-Status:\r\n\r\n211 End",
+		},
+		{
+			name:  "first and last line starting with digits are not indented",
+			reply: NewReply(213, "2 files", "3 bytes"),
+			want:  "213-2 files\r\n213 3 bytes",
+		},
+		{
+			name:  "CR and LF in single line are replaced",
+			reply: NewReply(550, "a\r\n226 b.txt: not found"),
+			want:  "550 a  226 b.txt: not found",
+		},
+		{
+			name:  "CR and LF in middle line are replaced",
+			reply: NewReply(211, "Status:", "a\nb\rc", "End"),
+			want:  "211-Status:\r\na b c\r\n211 End",
+		},
+		{
+			name:  "multiline reply helper",
+			reply: NewMultilineReply(211, "Status:", []string{"1", "x"}, "End"),
+			want:  "211-Status:\r\n 1\r\nx\r\n211 End",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.reply.String()
+			if got != test.want {
+				t.Errorf("String() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
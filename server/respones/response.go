@@ -2,106 +2,176 @@ package respones
 
 import (
 	"fmt"
-	"log"
 	"strings"
 )
 
-func formatResponse(responseCode int, message string) string {
-	return fmt.Sprintf("%d %s", responseCode, message)
+func UserLoggedIn() Reply {
+	return NewReply(230, "User logged in, proceed.")
 }
 
-func UserLoggedIn() string {
-	return formatResponse(230, "User logged in, proceed.")
+func UserLoggedInWithCertificate() Reply {
+	return NewReply(232, "User logged in, authorized by security data exchange.")
 }
 
-func PasswordNeeded() string {
-	return formatResponse(331, "User name okay, need password.")
+func PasswordNeeded() Reply {
+	return NewReply(331, "User name okay, need password.")
 }
 
-func BadSequence() string {
-	return formatResponse(503, "Bad sequence of commands.")
+func ServerReady() Reply {
+	return NewReply(220, "zmftp ready for new user.")
 }
-func ServerReady() string {
-	return formatResponse(220, "zmftp ready for new user.")
+
+func System() Reply {
+	return NewReply(215, "Zelvaman ultimate server")
 }
 
-func NotLoggedIn() string {
-	return formatResponse(530, "Not logged in / incorrect password.")
+// ListFeatures lists features for FEAT (RFC 2389), every feature line starts with space
+func ListFeatures(features []string) Reply {
+	return NewMultilineReply(211, "Features:", indent(features), "End")
 }
 
-func NotImplemented() string {
-	return formatResponse(502, "Command not implemented.")
+func EPSVEnabled(portNumber int) Reply {
+	message := fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", portNumber)
+	return NewReply(229, message)
 }
 
-func System() string {
-	return formatResponse(215, "Zelvaman ultimate server")
+func PassiveMode(address string) Reply {
+	return NewReply(227, fmt.Sprintf("Entering Passive Mode (%s)", address))
 }
 
-func ListFeatures(features []string) string {
-	var builder strings.Builder
+func SendingResponse() Reply {
+	return NewReply(150, "Here comes the data")
+}
 
-	builder.WriteString("211- Features: \n")
+func NotAllowed() Reply {
+	return NewReply(553, "Requested action not taken.")
+}
 
-	for _, feat := range features {
-		log.Printf("enabled feat: %s", feat)
+func SendPWD(path string) Reply {
+	msg := fmt.Sprintf("\"%s\" Returning working director", path)
+	return NewReply(257, msg)
 
-		builder.WriteString(" " + feat + "\n")
-	}
+}
 
-	builder.WriteString("211 end")
-	return builder.String()
+func CommandOkay() Reply {
+	return NewReply(200, "Command okay.")
 }
 
-func EPSVEnabled(portNumber int) string {
-	message := fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", portNumber)
-	return formatResponse(229, message)
+func FileActionOk() Reply {
+	return NewReply(250, "Requested file action okay, completed.")
 }
 
-func SendingResponse() string {
-	return formatResponse(150, "Here comes the data")
+func DataSendClosingConnection() Reply {
+	return NewReply(226, "Data send, now closing connection")
 }
 
-func NotAllowed() string {
-	return formatResponse(553, "Requested action not taken.")
+func StartUpload() Reply {
+	return NewReply(150, "You can start uploading now")
 }
 
-func SendPWD(path string) string {
-	msg := fmt.Sprintf("\"%s\" Returning working director", path)
-	return formatResponse(257, msg)
+func CantOpenDataConnection() Reply {
+	return NewReply(425, "Can't open data connection.")
+}
 
+func TransferAborted() Reply {
+	return NewReply(426, "Connection closed, transfer aborted")
+}
+func TooManyConnections() Reply {
+	return NewReply(421, "Too many connections")
 }
 
-func CommandOkay() string {
-	return formatResponse(200, "Command okay.")
+func IdleTimeout() Reply {
+	return NewReply(421, "Timeout, closing control connection.")
 }
 
-func FileActionOk() string {
-	return formatResponse(250, "Requested file action okay, completed.")
+func SessionExpired() Reply {
+	return NewReply(421, "Maximum session duration reached, closing control connection.")
 }
 
-func DataSendClosingConnection() string {
-	return formatResponse(226, "Data send, now closing connection")
+func LineTooLong() Reply {
+	return NewReply(500, "Command line too long.")
 }
 
-func GenericError() string {
-	return formatResponse(451, "Action aborted, error in processing")
+func PendingFurtherAction(nextAction string) Reply {
+	return NewReply(350, "Requested file action pending further information.")
 }
 
-func StartUpload() string {
-	return formatResponse(150, "You can start uploading now")
+func SecurityExchangeOkay() Reply {
+	return NewReply(234, "AUTH TLS okay, starting TLS handshake.")
 }
 
-func TransferAborted() string {
-	return formatResponse(426, "Connection closed, transfer aborted")
+func ProtectionBufferSize() Reply {
+	return NewReply(200, "PBSZ=0")
 }
-func ClosingControlConnection() string {
-	return formatResponse(221, "Closing control connection, Goodbye")
+
+func ServerStatus(lines []string) Reply {
+	return NewMultilineReply(211, "zmftp status:", indent(lines), "End of status")
+}
+
+func TransferStatus(lines []string) Reply {
+	return NewMultilineReply(213, "Status of transfer:", indent(lines), "End of status")
+}
+
+func FileStatus(path string, lines []string) Reply {
+	return NewMultilineReply(213, fmt.Sprintf("Status of %s:", path), indent(lines), "End of status")
+}
+
+func Help(commands []string) Reply {
+	lines := make([]string, 0, len(commands)/8+1)
+
+	// commands are listed in rows of 8
+	for start := 0; start < len(commands); start += 8 {
+		end := min(start+8, len(commands))
+		lines = append(lines, strings.Join(commands[start:end], " "))
+	}
+
+	return NewMultilineReply(214, "The following commands are recognized:", indent(lines), "Help OK.")
+}
+
+func HelpCommand(syntax string) Reply {
+	return NewReply(214, fmt.Sprintf("Syntax: %s", syntax))
+}
+
+func CommandSuperfluous() Reply {
+	return NewReply(202, "Command not implemented, superfluous at this site.")
+}
+
+func FileSize(size int64) Reply {
+	return NewReply(213, fmt.Sprintf("%d", size))
+}
+
+func ModificationTime(timeVal string) Reply {
+	return NewReply(213, timeVal)
+}
+
+func ModificationTimeSet(timeVal string, path string) Reply {
+	return NewReply(213, fmt.Sprintf("Modify=%s; %s", timeVal, path))
+}
+
+func RestartingAt(offset int64) Reply {
+	return NewReply(350, fmt.Sprintf("Restarting at %d. Send RETR to initiate transfer.", offset))
+}
+
+func Codepage(name string) Reply {
+	return NewReply(200, fmt.Sprintf("EBCDIC codepage is %s.", name))
+}
+
+func SiteCommandOkay(name string) Reply {
+	return NewReply(200, fmt.Sprintf("SITE %s command successful.", name))
+}
+
+func SiteHelp(commands []string) Reply {
+	return NewMultilineReply(214, "The following SITE commands are recognized:", indent(commands), "Help OK.")
+}
+
+func Who(sessions []string) Reply {
+	return NewMultilineReply(211, "Connected users:", indent(sessions), "End of list")
 }
 
-func FileUnavailable(path string) string {
-	return formatResponse(550, fmt.Sprintf("File %s doesnt exist", path))
+func IdleTime(seconds int, maxSeconds int) Reply {
+	return NewReply(200, fmt.Sprintf("Current idle time limit is %d seconds; max %d", seconds, maxSeconds))
 }
 
-func PendingFurtherAction(nextAction string) string {
-	return formatResponse(350, "Requested file action pending further information.")
+func IdleTimeSet(seconds int) Reply {
+	return NewReply(200, fmt.Sprintf("Maximum idle time set to %d seconds", seconds))
 }